@@ -61,6 +61,7 @@ export const SignalingProvider: React.FC<{ children: React.ReactNode }> = ({ chi
     const pendingJoinRef = useRef<string | null>(null);
     const clientIdRef = useRef<string | null>(null);
     const lastClientIdRef = useRef<string | null>(null);
+    const resumeTokenRef = useRef<string | null>(null);
 
     // Sync ref
     useEffect(() => {
@@ -159,6 +160,14 @@ export const SignalingProvider: React.FC<{ children: React.ReactNode }> = ({ chi
                                 if (msg.payload.turnToken) {
                                     setTurnToken(msg.payload.turnToken as string);
                                 }
+                                if (msg.payload.resumeToken) {
+                                    resumeTokenRef.current = msg.payload.resumeToken as string;
+                                }
+                            }
+                            break;
+                        case 'resume_token':
+                            if (msg.payload && msg.payload.resumeToken) {
+                                resumeTokenRef.current = msg.payload.resumeToken as string;
                             }
                             break;
                         case 'room_state':
@@ -238,9 +247,9 @@ export const SignalingProvider: React.FC<{ children: React.ReactNode }> = ({ chi
         currentRoomIdRef.current = roomId;
         if (wsRef.current && wsRef.current.readyState === WebSocket.OPEN) {
             const payload: any = { capabilities: { trickleIce: true } };
-            // If we have a previous client ID, send it to help server evict ghosts
-            if (lastClientIdRef.current) {
-                payload.reconnectCid = lastClientIdRef.current;
+            // If we had a previous seat, send its signed resume token to help server evict ghosts
+            if (lastClientIdRef.current && resumeTokenRef.current) {
+                payload.resumeToken = resumeTokenRef.current;
             }
             sendMessage('join', payload);
         } else {
@@ -253,6 +262,7 @@ export const SignalingProvider: React.FC<{ children: React.ReactNode }> = ({ chi
         sendMessage('leave');
         currentRoomIdRef.current = null;
         lastClientIdRef.current = null; // Clear last ID on explicit leave
+        resumeTokenRef.current = null;
         setRoomState(null);
     }, [sendMessage]);
 
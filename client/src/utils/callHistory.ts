@@ -6,7 +6,9 @@ export interface RecentCall {
 
 const STORAGE_KEY = 'serenada_call_history';
 const MAX_RECENT_CALLS = 3;
-const ROOM_ID_REGEX = /^[A-Za-z0-9_-]{27}$/;
+// 27 characters by default, 28 with a signed capacity byte; up to 55 with
+// ROOM_ID_RANDOM_BYTES=32 and a capacity byte (see server/room_id.go)
+const ROOM_ID_REGEX = /^[A-Za-z0-9_-]{27,55}$/;
 const UUID_REGEX = /^[a-fA-F0-9]{8}-[a-fA-F0-9]{4}-[a-fA-F0-9]{4}-[a-fA-F0-9]{4}-[a-fA-F0-9]{12}$/;
 
 const isValidRoomId = (roomId: string) => ROOM_ID_REGEX.test(roomId);
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// requireAdmin checks the X-Admin-Token header against ADMIN_TOKEN and
+// writes the error response if it doesn't match. Admin endpoints don't
+// exist (404) when ADMIN_TOKEN is unset.
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	token := strings.TrimSpace(os.Getenv("ADMIN_TOKEN"))
+	if token == "" {
+		http.NotFound(w, r)
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Admin-Token")), []byte(token)) != 1 {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+type roomStats struct {
+	RID              string                      `json:"rid"`
+	ParticipantCount int                         `json:"participantCount"`
+	ObserverCount    int                         `json:"observerCount"`
+	HostCID          string                      `json:"hostCid"`
+	CreatedAt        int64                       `json:"createdAt"`
+	LastActivity     int64                       `json:"lastActivity"`
+	DataBytes        int64                       `json:"dataBytes"` // data message bytes relayed, toward ROOM_BYTE_QUOTA
+	Messages         map[string]messageTypeStats `json:"messages"`  // received from members, by type
+}
+
+// handleStats serves GET /api/stats: a summary of every room plus totals.
+func handleStats(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requireAdmin(w, r) {
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		rooms := []roomStats{}
+		participants, observers := 0, 0
+		for _, room := range hub.rooms.snapshot() {
+			stats := func() roomStats {
+				room.mu.Lock()
+				defer room.mu.Unlock()
+				return roomStats{
+					RID:              room.RID,
+					ParticipantCount: len(room.Participants),
+					ObserverCount:    len(room.Observers),
+					HostCID:          room.HostCID,
+					CreatedAt:        room.CreatedAt.UnixMilli(),
+					LastActivity:     room.LastActivity.UnixMilli(),
+					DataBytes:        room.dataBytes,
+					Messages:         room.messages.snapshot(),
+				}
+			}()
+			participants += stats.ParticipantCount
+			observers += stats.ObserverCount
+			rooms = append(rooms, stats)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"rooms": rooms,
+			"totals": map[string]int{
+				"rooms":        len(rooms),
+				"participants": participants,
+				"observers":    observers,
+				"connections":  len(hub.clients.snapshot()),
+			},
+			"staleIceDropped": hub.staleDrops.Load(),
+			"writeTimeouts":   hub.writeTimeouts.Load(),
+			"messages":        hub.messages.snapshot(),
+		})
+	}
+}
+
+// Longest free-text reason accepted by admin actions
+const maxAdminReasonLength = 200
+
+// handleCloseRoom serves POST /api/admin/close-room {rid, reason}: it ends
+// the room for everyone as if the host had, without needing to be in it.
+func handleCloseRoom(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requireAdmin(w, r) {
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			RID    string `json:"rid"`
+			Reason string `json:"reason"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil || req.RID == "" {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+
+		room, ok := hub.rooms.get(req.RID)
+		if !ok {
+			http.Error(w, "Room not found", http.StatusNotFound)
+			return
+		}
+
+		reason := sanitizeText(req.Reason, maxAdminReasonLength)
+		if reason == "" {
+			reason = leaveReasonAdminClosed
+		}
+		log.Printf("[ADMIN] Closing room %s from %s: %s", req.RID, getClientIP(r), reason)
+		hub.endRoom(room, "admin", reason)
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleKickSID serves POST /api/admin/kick-sid {sid}: it takes one
+// session out of its room(s) with reason admin_kick and closes its
+// connection (code 4008 on WebSocket).
+func handleKickSID(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requireAdmin(w, r) {
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			SID string `json:"sid"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil || !validSID(req.SID) {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+
+		c, ok := hub.clients.get(req.SID)
+		if !ok {
+			http.Error(w, "Session not found", http.StatusNotFound)
+			return
+		}
+
+		log.Printf("[ADMIN] Kicking client %s (req %s, room %s) from %s", c.sid, c.reqID, c.currentRID(), getClientIP(r))
+		// Disconnecting here rather than from the transport's teardown gets
+		// the reason right and works even if the client's reader is stuck.
+		// It waits for a message of c's being handled to finish.
+		hub.disconnect(c, leaveReasonAdminKick)
+		c.closeWith(closeCodeKicked, "KICKED")
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Shortest TURN secret accepted by a rotation
+const minTurnSecretLength = 16
+
+// handleRotateTurnSecret serves POST /api/admin/turn-secret {secret,
+// overlapSeconds}: new TURN credentials are minted with the new secret
+// right away, while turn tokens signed with the old one stay valid for the
+// overlap (default 10 minutes). coturn must accept both secrets meanwhile.
+// The rotation lives in memory only; update TURN_SECRET before a restart.
+func handleRotateTurnSecret() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requireAdmin(w, r) {
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			Secret         string `json:"secret"`
+			OverlapSeconds *int   `json:"overlapSeconds"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		if len(req.Secret) < minTurnSecretLength {
+			http.Error(w, "Secret too short", http.StatusBadRequest)
+			return
+		}
+		overlap := turnSecretOverlap
+		if req.OverlapSeconds != nil {
+			if *req.OverlapSeconds < 0 {
+				http.Error(w, "Bad Request", http.StatusBadRequest)
+				return
+			}
+			overlap = time.Duration(*req.OverlapSeconds) * time.Second
+		}
+
+		rotateTurnSecret(req.Secret, overlap)
+		log.Printf("[ADMIN] TURN secret rotated from %s (old secret valid for %s)", getClientIP(r), overlap)
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// An admin kick can land while one of the session's messages is being
+// handled. It waits for that message, and a join that lost the race
+// doesn't put the kicked session back in a room. Run with -race.
+func TestKickSIDDuringMessage(t *testing.T) {
+	t.Setenv("ADMIN_TOKEN", "test-admin-token")
+	h := newTestHub(t)
+	kick := handleKickSID(h)
+
+	for i := 0; i < 50; i++ {
+		rid := newTestRoomID(t)
+		c := newTestClient(h)
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			sendJSON(h, c, `{"v":1,"type":"join","rid":%q}`, rid)
+		}()
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodPost, "/api/admin/kick-sid", strings.NewReader(fmt.Sprintf(`{"sid":%q}`, c.sid)))
+			req.Header.Set("X-Admin-Token", "test-admin-token")
+			rec := httptest.NewRecorder()
+			kick(rec, req)
+			if rec.Code != http.StatusNoContent {
+				t.Errorf("kick: status %d", rec.Code)
+			}
+		}()
+		wg.Wait()
+
+		if room, ok := h.rooms.get(rid); ok && room.participantCount() != 0 {
+			t.Fatalf("kicked client still in room %s", rid)
+		}
+	}
+}
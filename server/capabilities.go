@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"slices"
+)
+
+// Optional protocol features a client can advertise in hello
+const (
+	capBinary     = "binary"
+	capMediaState = "media_state"
+	capMultiParty = "multi-party"
+	capMultiRoom  = "multi-room"
+	capCompact    = "compact"
+	capSealed     = "sealed"
+)
+
+// serverCapabilities lists the features this server supports.
+// multi-party depends on MAX_PARTICIPANTS allowing more than two.
+func (h *Hub) serverCapabilities() []string {
+	caps := []string{capBinary, capMediaState, capMultiRoom, capCompact, capSealed}
+	if h.maxParticipants > 2 {
+		caps = append(caps, capMultiParty)
+	}
+	return caps
+}
+
+// hasCap reports whether c negotiated the capability. Clients that never
+// sent hello have none, so features gated on a capability stay off for them.
+func (c *Client) hasCap(name string) bool {
+	caps := c.caps.Load()
+	return caps != nil && slices.Contains(*caps, name)
+}
+
+// handleHello stores the intersection of the client's advertised features
+// and ours, and replies with it in a welcome message. It can be sent at
+// any time; the latest hello wins.
+func (h *Hub) handleHello(c *Client, msg Message) {
+	var payload struct {
+		Capabilities []string `json:"capabilities"`
+	}
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		c.sendError("", ErrBadRequest, "Invalid payload")
+		return
+	}
+
+	negotiated := []string{}
+	for _, cap := range h.serverCapabilities() {
+		if slices.Contains(payload.Capabilities, cap) {
+			negotiated = append(negotiated, cap)
+		}
+	}
+	c.caps.Store(&negotiated)
+
+	log.Printf("[HELLO] Client %s (req %s) negotiated capabilities %v", c.sid, c.reqID, negotiated)
+
+	welcomePayload, _ := json.Marshal(map[string]interface{}{
+		"capabilities": negotiated,
+		"minVersion":   minProtoVersion,
+		"maxVersion":   maxProtoVersion,
+	})
+	c.sendMessage(Message{
+		V:       1,
+		Type:    "welcome",
+		SID:     c.sid,
+		Payload: welcomePayload,
+	})
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+// conn_state is relayed only to members that negotiated media_state.
+func TestConnStateRelayGatedOnMediaState(t *testing.T) {
+	h := newTestHub(t)
+	h.maxParticipants = 3
+	rid := newTestRoomID(t)
+
+	reporter := newTestClient(h)
+	withCap := newTestClient(h)
+	withoutCap := newTestClient(h)
+	sendJSON(h, withCap, `{"v":1,"type":"hello","payload":{"capabilities":["media_state"]}}`)
+	sendJSON(h, withoutCap, `{"v":1,"type":"hello","payload":{"capabilities":["binary"]}}`)
+	for _, c := range []*Client{reporter, withCap, withoutCap} {
+		joinTestRoom(t, h, c, rid)
+	}
+	drain(withCap)
+	drain(withoutCap)
+
+	sendJSON(h, reporter, `{"v":1,"type":"conn_state","rid":%q,"payload":{"state":"connected"}}`, rid)
+
+	nextOfType(t, withCap, "conn_state")
+	select {
+	case out := <-withoutCap.send:
+		t.Fatalf("client without media_state got %s", out.data)
+	default:
+	}
+}
+
+// Whether a compact message can leave out rid depends on the recipient's
+// current room, which the recipient's own joins change while others send
+// to it. Run with -race.
+func TestCompactRIDWhileSwitchingRooms(t *testing.T) {
+	h := newTestHub(t)
+	h.relayRate, h.relayBurst = 1e9, 1e9
+	h.maxRoomSwitches = 0
+	h.emptyRoomGrace = 0
+	first, second := newTestRoomID(t), newTestRoomID(t)
+
+	a, b := newTestClient(h), newTestClient(h)
+	sendJSON(h, b, `{"v":1,"type":"hello","payload":{"capabilities":["compact"]}}`)
+	joinTestRoom(t, h, a, first)
+	sendJSON(h, b, `{"v":1,"type":"join","rid":%q}`, first) // compact, so not read back as a Message
+
+	done := make(chan struct{})
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		for {
+			select {
+			case <-a.send:
+			case <-b.send:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	// Relays are sent under the room lock, but room_state after a join or
+	// leave goes out after it's released
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			sendJSON(h, a, `{"v":1,"type":"ice","rid":%q,"payload":{"candidate":null}}`, first)
+			sendJSON(h, a, `{"v":1,"type":"leave","rid":%q}`, first)
+			sendJSON(h, a, `{"v":1,"type":"join","rid":%q}`, first)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			sendJSON(h, b, `{"v":1,"type":"join","rid":%q}`, second)
+			sendJSON(h, b, `{"v":1,"type":"join","rid":%q}`, first)
+		}
+	}()
+	wg.Wait()
+	close(done)
+	<-drained
+}
@@ -0,0 +1,289 @@
+// Package client is a thin Go client for the Serenada signaling protocol
+// over WebSocket, for bots and integration tests.
+//
+//	c, err := client.Dial(ctx, "wss://serenada.app/ws", nil)
+//	c.OnMessage(protocol.TypeOffer, func(m protocol.Message) { ... })
+//	joined, err := c.Join(ctx, roomID, protocol.JoinRequest{})
+//	err = c.SendOffer(peerCID, sdp)
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"sync"
+
+	"github.com/gorilla/websocket"
+
+	"serenada/server/protocol"
+)
+
+// ErrClosed is returned for requests on a connection that has gone away
+var ErrClosed = errors.New("signaling connection closed")
+
+// Client is one signaling connection. It is in at most one room at a time.
+type Client struct {
+	conn    *websocket.Conn
+	writeMu sync.Mutex
+
+	mu       sync.Mutex
+	handlers map[string][]func(protocol.Message) // by type, "" for all
+	waiters  map[*waiter]struct{}
+	sid      string
+	rid      string
+	cid      string
+
+	done chan struct{}
+	err  error // why the connection ended, set before done is closed
+}
+
+// Error codes that answer a request, by request. Any message can be
+// answered with the envelope errors; others, like a RELAY_RATE_LIMITED for
+// an earlier relay, are unrelated and leave the request waiting.
+var (
+	envelopeErrors = []string{protocol.CodeBadRequest, protocol.CodeUnsupportedVersion, protocol.CodeMessageTooLarge}
+	joinErrors     = append([]string{
+		protocol.CodeInvalidRoomID,
+		protocol.CodeUnauthorized,
+		protocol.CodeRoomFull,
+		protocol.CodeRoomQuotaExceeded,
+		protocol.CodeTooManyRoomSwitches,
+		protocol.CodeServerNotConfigured,
+		protocol.CodeNameTaken,
+	}, envelopeErrors...)
+	leaveErrors = envelopeErrors
+)
+
+type waiter struct {
+	match func(protocol.Message) bool
+	ch    chan protocol.Message
+}
+
+// Dial connects to a signaling endpoint such as wss://host/ws. header is
+// sent with the handshake, e.g. an Origin the server allows; it may be nil.
+func Dial(ctx context.Context, url string, header http.Header) (*Client, error) {
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, url, header)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{
+		conn:     conn,
+		handlers: make(map[string][]func(protocol.Message)),
+		waiters:  make(map[*waiter]struct{}),
+		done:     make(chan struct{}),
+	}
+	go c.readLoop()
+	return c, nil
+}
+
+// OnMessage registers fn for messages of msgType, or for every message if
+// msgType is empty. Handlers run in order on the read goroutine, so they
+// must not block or wait on replies.
+func (c *Client) OnMessage(msgType string, fn func(protocol.Message)) {
+	c.mu.Lock()
+	c.handlers[msgType] = append(c.handlers[msgType], fn)
+	c.mu.Unlock()
+}
+
+// SID, RID and CID report the session, room and client ID from the last
+// joined, or "" before joining and after leaving.
+func (c *Client) SID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sid
+}
+
+func (c *Client) RID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rid
+}
+
+func (c *Client) CID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cid
+}
+
+// Done is closed when the connection ends; Err then reports why.
+func (c *Client) Done() <-chan struct{} { return c.done }
+
+func (c *Client) Err() error {
+	select {
+	case <-c.done:
+		return c.err
+	default:
+		return nil
+	}
+}
+
+// Close closes the connection without leaving first.
+func (c *Client) Close() error {
+	err := c.conn.Close()
+	<-c.done
+	return err
+}
+
+// Send sends msg, filling in the version and, when unset, the current room.
+func (c *Client) Send(msg protocol.Message) error {
+	if msg.V == 0 {
+		msg.V = protocol.Version
+	}
+	if msg.RID == "" {
+		msg.RID = c.RID()
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// sendPayload sends a message of msgType with payload encoded as JSON.
+func (c *Client) sendPayload(msgType, to string, payload any) error {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return c.Send(protocol.Message{Type: msgType, To: to, Payload: raw})
+}
+
+// Join joins room rid and waits for the server's answer. A rejection is
+// returned as a *protocol.Error.
+func (c *Client) Join(ctx context.Context, rid string, req protocol.JoinRequest) (*protocol.Joined, error) {
+	reply, err := c.request(ctx, protocol.Message{Type: protocol.TypeJoin, RID: rid}, req, joinErrors, func(m protocol.Message) bool {
+		return m.Type == protocol.TypeJoined && m.RID == rid
+	})
+	if err != nil {
+		return nil, err
+	}
+	var joined protocol.Joined
+	if err := reply.DecodePayload(&joined); err != nil {
+		return nil, err
+	}
+	return &joined, nil
+}
+
+// Leave leaves the current room and waits for the server to confirm.
+func (c *Client) Leave(ctx context.Context) error {
+	rid := c.RID()
+	if rid == "" {
+		return nil
+	}
+	_, err := c.request(ctx, protocol.Message{Type: protocol.TypeLeave, RID: rid}, nil, leaveErrors, func(m protocol.Message) bool {
+		return m.Type == protocol.TypeLeft && m.RID == rid
+	})
+	return err
+}
+
+// SendOffer, SendAnswer and SendICE relay WebRTC negotiation to the
+// participant to, or to everyone else in the room when to is "".
+func (c *Client) SendOffer(to, sdp string) error {
+	return c.sendPayload(protocol.TypeOffer, to, protocol.SDP{SDP: sdp})
+}
+
+func (c *Client) SendAnswer(to, sdp string) error {
+	return c.sendPayload(protocol.TypeAnswer, to, protocol.SDP{SDP: sdp})
+}
+
+func (c *Client) SendICE(to string, candidate protocol.ICECandidate) error {
+	return c.sendPayload(protocol.TypeICE, to, protocol.ICE{Candidate: candidate})
+}
+
+// request sends msg with payload and waits for the first message matching
+// reply, or an error about the same room with one of errCodes.
+func (c *Client) request(ctx context.Context, msg protocol.Message, payload any, errCodes []string, reply func(protocol.Message) bool) (protocol.Message, error) {
+	if payload != nil {
+		raw, err := json.Marshal(payload)
+		if err != nil {
+			return protocol.Message{}, err
+		}
+		msg.Payload = raw
+	}
+
+	// Registered before sending, so a fast reply can't be missed
+	w := &waiter{
+		match: func(m protocol.Message) bool {
+			if reply(m) {
+				return true
+			}
+			if m.Type != protocol.TypeError || (m.RID != msg.RID && m.RID != "") {
+				return false
+			}
+			var e protocol.Error
+			return m.DecodePayload(&e) == nil && slices.Contains(errCodes, e.Code)
+		},
+		ch: make(chan protocol.Message, 1),
+	}
+	c.mu.Lock()
+	c.waiters[w] = struct{}{}
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.waiters, w)
+		c.mu.Unlock()
+	}()
+
+	if err := c.Send(msg); err != nil {
+		return protocol.Message{}, err
+	}
+
+	select {
+	case m := <-w.ch:
+		if m.Type == protocol.TypeError {
+			var e protocol.Error
+			if err := m.DecodePayload(&e); err != nil {
+				return protocol.Message{}, err
+			}
+			return protocol.Message{}, &e
+		}
+		return m, nil
+	case <-c.done:
+		return protocol.Message{}, ErrClosed
+	case <-ctx.Done():
+		return protocol.Message{}, ctx.Err()
+	}
+}
+
+func (c *Client) readLoop() {
+	defer close(c.done)
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			c.err = err
+			return
+		}
+		var msg protocol.Message
+		if err := json.Unmarshal(data, &msg); err != nil {
+			continue
+		}
+
+		c.mu.Lock()
+		switch msg.Type {
+		case protocol.TypeJoined:
+			c.sid, c.rid, c.cid = msg.SID, msg.RID, msg.CID
+		case protocol.TypeLeft, protocol.TypeRoomEnded:
+			if msg.RID == c.rid {
+				c.rid, c.cid = "", ""
+			}
+		}
+		var handlers []func(protocol.Message)
+		handlers = append(handlers, c.handlers[""]...)
+		handlers = append(handlers, c.handlers[msg.Type]...)
+		for w := range c.waiters {
+			if w.match(msg) {
+				delete(c.waiters, w)
+				w.ch <- msg
+			}
+		}
+		c.mu.Unlock()
+
+		for _, fn := range handlers {
+			fn(msg)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import "encoding/json"
+
+// compactMessage is the envelope sent to clients that negotiated the
+// compact capability: one-letter keys, and no rid on messages about the
+// room the client is in. Payloads are unchanged. Only server-to-client
+// messages are compact; clients still send the regular envelope.
+//
+// For a trickle-ICE relay this saves 47 bytes per message (the type, seq
+// and payload keys plus a 27-character rid): a typical browser srflx
+// candidate goes from 317 to 270 bytes, about 15% less on the wire.
+type compactMessage struct {
+	V       int             `json:"v"`
+	Type    string          `json:"t"`
+	RID     string          `json:"r,omitempty"`
+	SID     string          `json:"s,omitempty"`
+	CID     string          `json:"c,omitempty"`
+	To      string          `json:"o,omitempty"`
+	Seq     int64           `json:"q,omitempty"`
+	From    string          `json:"f,omitempty"`
+	Payload json.RawMessage `json:"p,omitempty"`
+}
+
+// encodeMessage marshals msg in the envelope and codec c negotiated.
+func (c *Client) encodeMessage(msg interface{}) ([]byte, error) {
+	m, ok := msg.(Message)
+	if !ok {
+		b, err := json.Marshal(msg)
+		if err != nil || !c.binary {
+			return b, err
+		}
+		return jsonToMsgpack(b)
+	}
+
+	keys := &messageKeys
+	if c.hasCap(capCompact) {
+		// Multi-room clients need rid to tell their rooms apart. This runs on
+		// the sender's goroutine, so c's room is read under its lock.
+		if m.RID != "" && !c.hasCap(capMultiRoom) && m.RID == c.currentRID() {
+			m.RID = ""
+		}
+		keys = &compactKeys
+		if !c.binary {
+			return json.Marshal(compactMessage{
+				V:       m.V,
+				Type:    m.Type,
+				RID:     m.RID,
+				SID:     m.SID,
+				CID:     m.CID,
+				To:      m.To,
+				Seq:     m.Seq,
+				From:    m.From,
+				Payload: m.Payload,
+			})
+		}
+	}
+	if !c.binary {
+		return json.Marshal(m)
+	}
+	// Usually enough for the payload plus the envelope
+	return appendMsgpackMessage(make([]byte, 0, len(m.Payload)+128), m, keys)
+}
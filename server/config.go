@@ -0,0 +1,64 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// envDuration reads a duration such as "30s" from the environment,
+// falling back to def when unset or invalid.
+func envDuration(name string, def time.Duration) time.Duration {
+	raw := strings.TrimSpace(os.Getenv(name))
+	if raw == "" {
+		return def
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil || d <= 0 {
+		log.Printf("[CONFIG] Invalid %s=%q, using default %s", name, raw, def)
+		return def
+	}
+	return d
+}
+
+// envDurationOrOff is envDuration for features that can be turned off:
+// a value of "0" returns 0.
+func envDurationOrOff(name string, def time.Duration) time.Duration {
+	if strings.TrimSpace(os.Getenv(name)) == "0" {
+		return 0
+	}
+	return envDuration(name, def)
+}
+
+// envInt reads a non-negative integer from the environment,
+// falling back to def when unset or invalid.
+func envInt(name string, def int) int {
+	raw := strings.TrimSpace(os.Getenv(name))
+	if raw == "" {
+		return def
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 0 {
+		log.Printf("[CONFIG] Invalid %s=%q, using default %d", name, raw, def)
+		return def
+	}
+	return n
+}
+
+// envBool reads a boolean ("true", "false", "1", "0", ... as accepted by
+// strconv.ParseBool) from the environment, falling back to def when unset
+// or invalid.
+func envBool(name string, def bool) bool {
+	raw := strings.TrimSpace(os.Getenv(name))
+	if raw == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(raw)
+	if err != nil {
+		log.Printf("[CONFIG] Invalid %s=%q, using default %t", name, raw, def)
+		return def
+	}
+	return b
+}
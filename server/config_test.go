@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+// Boolean settings take any spelling strconv.ParseBool does, and fall back
+// to their default when unset or unparsable.
+func TestEnvBool(t *testing.T) {
+	for _, tc := range []struct {
+		raw       string
+		def, want bool
+	}{
+		{"", true, true},
+		{"", false, false},
+		{"0", true, false},
+		{"false", true, false},
+		{" FALSE ", true, false},
+		{"1", false, true},
+		{"true", false, true},
+		{"T", false, true},
+		{"yes", true, true},
+		{"off", false, false},
+	} {
+		t.Setenv("TEST_ENV_BOOL", tc.raw)
+		if got := envBool("TEST_ENV_BOOL", tc.def); got != tc.want {
+			t.Errorf("envBool(%q, %t) = %t, want %t", tc.raw, tc.def, got, tc.want)
+		}
+	}
+
+	t.Setenv("LOG_RELAYS", "true")
+	t.Setenv("LOG_REDACT_SDP", "false")
+	if cfg := loadRelayLogConfig(); !cfg.enabled || cfg.redact {
+		t.Errorf("LOG_RELAYS=true LOG_REDACT_SDP=false: got %+v", cfg)
+	}
+}
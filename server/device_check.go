@@ -1,6 +1,9 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
 	"html/template"
 	"net/http"
 )
@@ -129,8 +132,8 @@ const deviceCheckHTML = `
 
         <div class="actions">
             <a href="/" class="btn btn-secondary" style="text-decoration: none; display: flex; align-items: center; justify-content: center;">Back to Home</a>
-            <button class="btn" id="copy-btn" onclick="copyDiagnostics()">Copy Diagnostic Data</button>
-            <button class="btn btn-secondary" onclick="window.location.reload()">Refresh</button>
+            <button class="btn" id="copy-btn">Copy Diagnostic Data</button>
+            <button class="btn btn-secondary" id="refresh-btn">Refresh</button>
         </div>
 
         <div class="card">
@@ -143,6 +146,10 @@ const deviceCheckHTML = `
                 <span class="label">Client IP</span>
                 <span class="value" id="client-ip">{{.ClientIP}}</span>
             </div>
+            <div class="item">
+                <span class="label">Request ID</span>
+                <span class="value" id="request-id">{{.RequestID}}</span>
+            </div>
             <div class="item">
                 <span class="label">User Agent</span>
                 <span class="value" id="ua">-</span>
@@ -190,7 +197,7 @@ const deviceCheckHTML = `
         <div class="card">
             <div class="card-title">
                 Media Devices
-                <button class="btn" onclick="requestMediaPermissions()" style="margin: 0; padding: 0.25rem 0.5rem; font-size: 0.75rem;">Test Permissions</button>
+                <button class="btn" id="permissions-btn" style="margin: 0; padding: 0.25rem 0.5rem; font-size: 0.75rem;">Test Permissions</button>
             </div>
             <div id="media-status-container" class="item">
                 <span class="label">Permission Status</span>
@@ -218,8 +225,8 @@ const deviceCheckHTML = `
             <div class="card-title">
                 ICE Connectivity (STUN/TURN)
                 <div style="display: flex; gap: 0.5rem;">
-                    <button class="btn" id="ice-test-btn" onclick="runIceTest()" style="margin: 0; padding: 0.25rem 0.5rem; font-size: 0.75rem;">Run Full Test</button>
-                    <button class="btn btn-secondary" id="ice-test-turns-btn" onclick="runIceTest(true)" style="margin: 0; padding: 0.25rem 0.5rem; font-size: 0.75rem; background-color: #6366f1;">Run TURNS Only</button>
+                    <button class="btn" id="ice-test-btn" style="margin: 0; padding: 0.25rem 0.5rem; font-size: 0.75rem;">Run Full Test</button>
+                    <button class="btn btn-secondary" id="ice-test-turns-btn" style="margin: 0; padding: 0.25rem 0.5rem; font-size: 0.75rem; background-color: #6366f1;">Run TURNS Only</button>
                 </div>
             </div>
             <div class="item">
@@ -236,7 +243,7 @@ const deviceCheckHTML = `
         </div>
     </div>
 
-    <script>
+    <script nonce="{{.Nonce}}">
         // Use var for better compatibility with older JS engines
         function updateStatus(id, status, text) {
             var el = document.getElementById(id);
@@ -301,7 +308,7 @@ const deviceCheckHTML = `
             
             fetch('/api/diagnostic-token', { method: 'POST' })
                 .then(function(res) {
-                    if (!res.ok) throw new Error('Failed to fetch diagnostic token: ' + res.status);
+                    if (!res.ok) return failedResponse(res, 'Failed to fetch diagnostic token');
                     return res.json();
                 })
                 .then(function(data) {
@@ -312,7 +319,7 @@ const deviceCheckHTML = `
                     });
                 })
                 .then(function(res) {
-                    if (!res.ok) throw new Error('Failed to fetch credentials: ' + res.status);
+                    if (!res.ok) return failedResponse(res, 'Failed to fetch credentials');
                     return res.json();
                 })
                 .then(function(config) {
@@ -335,6 +342,19 @@ const deviceCheckHTML = `
                 });
         }
 
+        // Rejects with an error for a failed response, including the retry
+        // delay from the JSON body of a 429
+        function failedResponse(res, what) {
+            if (res.status !== 429) {
+                return Promise.reject(new Error(what + ': ' + res.status));
+            }
+            return res.json().then(function(body) {
+                throw new Error(what + ': rate limited, retry in ' + body.retryAfter + 's');
+            }, function() {
+                throw new Error(what + ': ' + res.status);
+            });
+        }
+
         function testIceConfig(config, turnsOnly) {
             logIce('ICE Servers: ' + JSON.stringify(config.uris));
             
@@ -697,6 +717,13 @@ const deviceCheckHTML = `
             }
         }
 
+        // Inline handlers are blocked by the page's CSP, so bind them here
+        document.getElementById('copy-btn').addEventListener('click', copyDiagnostics);
+        document.getElementById('refresh-btn').addEventListener('click', function() { window.location.reload(); });
+        document.getElementById('permissions-btn').addEventListener('click', requestMediaPermissions);
+        document.getElementById('ice-test-btn').addEventListener('click', function() { runIceTest(); });
+        document.getElementById('ice-test-turns-btn').addEventListener('click', function() { runIceTest(true); });
+
         // Run core checks on load
         checkBrowser();
         checkWebRTC();
@@ -714,14 +741,47 @@ func handleDeviceCheck(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Error loading template", http.StatusInternalServerError)
 		return
 	}
+	nonce, err := newCSPNonce()
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
 	clientIP := getClientIP(r)
 	if clientIP == "" {
 		clientIP = "Unknown"
 	}
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	setDeviceCheckHeaders(w, nonce)
 	tmpl.Execute(w, struct {
-		ClientIP string
+		ClientIP  string
+		RequestID string
+		Nonce     string
 	}{
-		ClientIP: clientIP,
+		ClientIP:  clientIP,
+		RequestID: requestID(r),
+		Nonce:     nonce,
 	})
 }
+
+// newCSPNonce returns a fresh random nonce for one page response.
+func newCSPNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// setDeviceCheckHeaders locks the diagnostics page down to its own nonced
+// script and same-origin requests. Styles stay inline-permitted since the
+// markup uses style attributes throughout.
+func setDeviceCheckHeaders(w http.ResponseWriter, nonce string) {
+	h := w.Header()
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	h.Set("Cache-Control", "no-store")
+	h.Set("Content-Security-Policy", fmt.Sprintf(
+		"default-src 'none'; script-src 'nonce-%s'; style-src 'unsafe-inline'; connect-src 'self'; base-uri 'none'; form-action 'none'; frame-ancestors 'none'",
+		nonce))
+	h.Set("X-Frame-Options", "DENY")
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Referrer-Policy", "no-referrer")
+}
@@ -0,0 +1,60 @@
+package main
+
+import "serenada/server/protocol"
+
+// ErrorCode is the code carried in an error message's payload.
+type ErrorCode string
+
+const (
+	ErrBadRequest          ErrorCode = protocol.CodeBadRequest
+	ErrUnsupportedVersion  ErrorCode = protocol.CodeUnsupportedVersion
+	ErrMessageTooLarge     ErrorCode = protocol.CodeMessageTooLarge
+	ErrInvalidRoomID       ErrorCode = protocol.CodeInvalidRoomID
+	ErrUnauthorized        ErrorCode = protocol.CodeUnauthorized
+	ErrNotHost             ErrorCode = protocol.CodeNotHost
+	ErrObserverReadonly    ErrorCode = protocol.CodeObserverReadonly
+	ErrCannotRelayToSelf   ErrorCode = protocol.CodeCannotRelayToSelf
+	ErrRoomFull            ErrorCode = protocol.CodeRoomFull
+	ErrRoomQuotaExceeded   ErrorCode = protocol.CodeRoomQuotaExceeded
+	ErrTooManyRoomSwitches ErrorCode = protocol.CodeTooManyRoomSwitches
+	ErrRelayRateLimited    ErrorCode = protocol.CodeRelayRateLimited
+	ErrServerNotConfigured ErrorCode = protocol.CodeServerNotConfigured
+	ErrNameTaken           ErrorCode = protocol.CodeNameTaken
+	ErrBadNegotiationState ErrorCode = protocol.CodeBadNegotiationState
+	ErrRoomClosed          ErrorCode = protocol.CodeRoomClosed
+	ErrQuotaExceeded       ErrorCode = protocol.CodeQuotaExceeded
+)
+
+// Error categories, sent with every error so clients can decide what to do
+// without knowing each code.
+const (
+	errorCategoryClient = "client" // malformed or invalid request; fix it, don't retry
+	errorCategoryState  = "state"  // not allowed in the current room state; may succeed once it changes
+	errorCategoryLimit  = "limit"  // a limit or quota was hit; retry later
+	errorCategoryServer = "server" // server-side problem; retry later
+)
+
+type errorCodeInfo struct {
+	category  string
+	retryable bool
+}
+
+var errorCodes = map[ErrorCode]errorCodeInfo{
+	ErrBadRequest:          {errorCategoryClient, false},
+	ErrUnsupportedVersion:  {errorCategoryClient, false},
+	ErrMessageTooLarge:     {errorCategoryClient, false},
+	ErrInvalidRoomID:       {errorCategoryClient, false},
+	ErrUnauthorized:        {errorCategoryClient, false},
+	ErrNotHost:             {errorCategoryState, false},
+	ErrObserverReadonly:    {errorCategoryState, false},
+	ErrCannotRelayToSelf:   {errorCategoryClient, false},
+	ErrRoomFull:            {errorCategoryState, true},
+	ErrRoomQuotaExceeded:   {errorCategoryLimit, true},
+	ErrTooManyRoomSwitches: {errorCategoryLimit, true},
+	ErrRelayRateLimited:    {errorCategoryLimit, true},
+	ErrServerNotConfigured: {errorCategoryServer, true},
+	ErrNameTaken:           {errorCategoryState, false},
+	ErrBadNegotiationState: {errorCategoryState, false},
+	ErrRoomClosed:          {errorCategoryState, false},
+	ErrQuotaExceeded:       {errorCategoryLimit, false},
+}
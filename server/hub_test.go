@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestMain(m *testing.M) {
+	os.Setenv("ROOM_ID_SECRET", "test-room-id-secret")
+	os.Setenv("TURN_SECRET", "test-turn-secret")
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// newTestHub returns a hub without its run loop and without the per-IP
+// room quota, so a test can create as many rooms as it likes.
+func newTestHub(tb testing.TB) *Hub {
+	tb.Helper()
+	h := newHub()
+	h.roomQuota = NewIPRoomQuota(0, time.Hour)
+	return h
+}
+
+// newTestClient registers a connection-less client. It behaves like a
+// poll client: messages for it pile up in c.send until a test reads them.
+func newTestClient(h *Hub) *Client {
+	c := &Client{
+		hub:       h,
+		send:      make(chan outMessage, h.sendBuffer),
+		sid:       generateID("S-"),
+		ip:        "192.0.2.1",
+		transport: TransportPoll,
+		reqID:     generateID("R-"),
+		done:      make(chan struct{}),
+	}
+	c.lastSeen.Store(time.Now().UnixNano())
+	h.clients.add(c)
+	return c
+}
+
+func newTestRoomID(tb testing.TB) string {
+	tb.Helper()
+	rid, err := generateRoomID(0, false)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return rid
+}
+
+// sendJSON hands c's message to the hub as if it arrived on the wire.
+func sendJSON(h *Hub, c *Client, format string, args ...any) {
+	h.handleMessage(c, []byte(fmt.Sprintf(format, args...)))
+}
+
+// drain discards everything queued for c.
+func drain(c *Client) {
+	for {
+		select {
+		case <-c.send:
+		default:
+			return
+		}
+	}
+}
+
+// nextOfType returns the first queued message for c of type msgType,
+// discarding the ones before it. It fails if there is none.
+func nextOfType(tb testing.TB, c *Client, msgType string) Message {
+	tb.Helper()
+	for {
+		select {
+		case out := <-c.send:
+			var msg Message
+			if err := json.Unmarshal(out.data, &msg); err != nil {
+				tb.Fatalf("undecodable message %s: %v", out.data, err)
+			}
+			if msg.Type == msgType {
+				return msg
+			}
+		default:
+			tb.Fatalf("client %s got no %s message", c.sid, msgType)
+			return Message{}
+		}
+	}
+}
+
+// joinTestRoom joins c to rid and returns the joined payload.
+func joinTestRoom(tb testing.TB, h *Hub, c *Client, rid string) map[string]any {
+	tb.Helper()
+	sendJSON(h, c, `{"v":1,"type":"join","rid":%q}`, rid)
+	joined := nextOfType(tb, c, "joined")
+	var payload map[string]any
+	if err := json.Unmarshal(joined.Payload, &payload); err != nil {
+		tb.Fatal(err)
+	}
+	return payload
+}
+
+// dialTestWS connects a real WebSocket client to h and returns it along
+// with the hub's side of the connection.
+func dialTestWS(tb testing.TB, h *Hub, subprotocols ...string) (*websocket.Conn, *Client) {
+	tb.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWs(h, w, r)
+	}))
+	tb.Cleanup(srv.Close)
+
+	dialer := websocket.Dialer{Subprotocols: subprotocols}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { conn.Close() })
+
+	// serveWs registers the client right after the upgrade response
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, c := range h.clients.snapshot() {
+			if c.conn != nil && c.conn.RemoteAddr().String() == conn.LocalAddr().String() {
+				return conn, c
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+	tb.Fatal("WebSocket client never registered")
+	return nil, nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxICECheckCandidates = 200
+	maxICECheckBodyBytes  = 65536
+)
+
+// ICECandidate is the parsed form of an a=candidate line (RFC 8839).
+type ICECandidate struct {
+	Foundation string `json:"foundation"`
+	Component  int    `json:"component"`
+	Protocol   string `json:"protocol"` // udp or tcp
+	Priority   uint32 `json:"priority"`
+	Address    string `json:"address"`
+	Port       int    `json:"port"`
+	Type       string `json:"type"` // host, srflx, prflx, relay
+	RelAddr    string `json:"relAddr,omitempty"`
+	RelPort    int    `json:"relPort,omitempty"`
+	TCPType    string `json:"tcpType,omitempty"`
+}
+
+// parseICECandidate parses a candidate line with or without the "a=" prefix, e.g.
+// "candidate:842163049 1 udp 1677729535 203.0.113.7 54321 typ srflx raddr 10.0.0.2 rport 54321".
+func parseICECandidate(line string) (ICECandidate, error) {
+	line = strings.TrimSpace(line)
+	line = strings.TrimPrefix(line, "a=")
+	if !strings.HasPrefix(line, "candidate:") {
+		return ICECandidate{}, errors.New("not a candidate line")
+	}
+	fields := strings.Fields(strings.TrimPrefix(line, "candidate:"))
+	if len(fields) < 8 || fields[6] != "typ" {
+		return ICECandidate{}, errors.New("malformed candidate line")
+	}
+
+	component, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return ICECandidate{}, errors.New("invalid component")
+	}
+	priority, err := strconv.ParseUint(fields[3], 10, 32)
+	if err != nil {
+		return ICECandidate{}, errors.New("invalid priority")
+	}
+	port, err := strconv.Atoi(fields[5])
+	if err != nil || port < 0 || port > 65535 {
+		return ICECandidate{}, errors.New("invalid port")
+	}
+
+	cand := ICECandidate{
+		Foundation: fields[0],
+		Component:  component,
+		Protocol:   strings.ToLower(fields[2]),
+		Priority:   uint32(priority),
+		Address:    fields[4],
+		Port:       port,
+		Type:       strings.ToLower(fields[7]),
+	}
+
+	// Remaining fields are name/value extension pairs
+	for i := 8; i+1 < len(fields); i += 2 {
+		switch fields[i] {
+		case "raddr":
+			cand.RelAddr = fields[i+1]
+		case "rport":
+			cand.RelPort, _ = strconv.Atoi(fields[i+1])
+		case "tcptype":
+			cand.TCPType = strings.ToLower(fields[i+1])
+		}
+	}
+
+	return cand, nil
+}
+
+type iceCheckResult struct {
+	HasHost     bool     `json:"hasHost"`
+	HasSrflx    bool     `json:"hasSrflx"`
+	HasRelay    bool     `json:"hasRelay"`
+	RelayProtos []string `json:"relayProtos"`
+	Invalid     int      `json:"invalid"`
+}
+
+func summarizeICECandidates(lines []string) iceCheckResult {
+	result := iceCheckResult{RelayProtos: []string{}}
+	seenProtos := make(map[string]bool)
+	for _, line := range lines {
+		cand, err := parseICECandidate(line)
+		if err != nil {
+			result.Invalid++
+			continue
+		}
+		switch cand.Type {
+		case "host":
+			result.HasHost = true
+		case "srflx":
+			result.HasSrflx = true
+		case "relay":
+			result.HasRelay = true
+			if !seenProtos[cand.Protocol] {
+				seenProtos[cand.Protocol] = true
+				result.RelayProtos = append(result.RelayProtos, cand.Protocol)
+			}
+		}
+	}
+	return result
+}
+
+// handleICECheck serves POST /api/ice-check. The body is
+// {"candidates": ["candidate:...", ...]} as gathered by the client.
+func handleICECheck() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			Candidates []string `json:"candidates"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxICECheckBodyBytes)).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if len(req.Candidates) > maxICECheckCandidates {
+			http.Error(w, "Too many candidates", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(summarizeICECandidates(req.Candidates))
+	}
+}
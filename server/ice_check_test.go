@@ -0,0 +1,97 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseICECandidate(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want ICECandidate
+	}{
+		{
+			name: "ipv4 host udp",
+			line: "a=candidate:1467250027 1 udp 2122260223 192.168.0.196 46243 typ host generation 0",
+			want: ICECandidate{Foundation: "1467250027", Component: 1, Protocol: "udp", Priority: 2122260223,
+				Address: "192.168.0.196", Port: 46243, Type: "host"},
+		},
+		{
+			name: "ipv4 srflx without prefix",
+			line: "candidate:842163049 1 udp 1677729535 203.0.113.7 54321 typ srflx raddr 10.0.0.2 rport 54321 generation 0 ufrag EsAw network-id 1",
+			want: ICECandidate{Foundation: "842163049", Component: 1, Protocol: "udp", Priority: 1677729535,
+				Address: "203.0.113.7", Port: 54321, Type: "srflx", RelAddr: "10.0.0.2", RelPort: 54321},
+		},
+		{
+			name: "ipv6 host udp",
+			line: "a=candidate:3317540276 1 udp 2122197247 2001:db8:85a3::8a2e:370:7334 51472 typ host generation 0 network-id 2",
+			want: ICECandidate{Foundation: "3317540276", Component: 1, Protocol: "udp", Priority: 2122197247,
+				Address: "2001:db8:85a3::8a2e:370:7334", Port: 51472, Type: "host"},
+		},
+		{
+			name: "ipv6 srflx",
+			line: "a=candidate:2999745851 1 udp 1686052607 2001:db8::1 61500 typ srflx raddr fe80::1 rport 61500",
+			want: ICECandidate{Foundation: "2999745851", Component: 1, Protocol: "udp", Priority: 1686052607,
+				Address: "2001:db8::1", Port: 61500, Type: "srflx", RelAddr: "fe80::1", RelPort: 61500},
+		},
+		{
+			name: "tcp active host",
+			line: "a=candidate:1052214479 1 tcp 1518280447 192.168.0.196 9 typ host tcptype active generation 0",
+			want: ICECandidate{Foundation: "1052214479", Component: 1, Protocol: "tcp", Priority: 1518280447,
+				Address: "192.168.0.196", Port: 9, Type: "host", TCPType: "active"},
+		},
+		{
+			name: "ipv6 tcp passive host",
+			line: "candidate:2406716599 1 TCP 1518217983 2001:db8::2 9 typ host tcptype PASSIVE",
+			want: ICECandidate{Foundation: "2406716599", Component: 1, Protocol: "tcp", Priority: 1518217983,
+				Address: "2001:db8::2", Port: 9, Type: "host", TCPType: "passive"},
+		},
+		{
+			name: "udp relay",
+			line: "a=candidate:2157334355 1 udp 41885439 198.51.100.4 443 typ relay raddr 203.0.113.7 rport 54321 generation 0",
+			want: ICECandidate{Foundation: "2157334355", Component: 1, Protocol: "udp", Priority: 41885439,
+				Address: "198.51.100.4", Port: 443, Type: "relay", RelAddr: "203.0.113.7", RelPort: 54321},
+		},
+		{
+			name: "tcp relay",
+			line: "a=candidate:3745283045 1 tcp 25042943 198.51.100.4 443 typ relay raddr 203.0.113.7 rport 50123 tcptype passive",
+			want: ICECandidate{Foundation: "3745283045", Component: 1, Protocol: "tcp", Priority: 25042943,
+				Address: "198.51.100.4", Port: 443, Type: "relay", RelAddr: "203.0.113.7", RelPort: 50123, TCPType: "passive"},
+		},
+		{
+			name: "mdns host rtcp component",
+			line: "a=candidate:1 2 udp 2122260222 3f9b1c2e-7a44-4d5f-9a1e-0c2b8d6e4f10.local 46244 typ host",
+			want: ICECandidate{Foundation: "1", Component: 2, Protocol: "udp", Priority: 2122260222,
+				Address: "3f9b1c2e-7a44-4d5f-9a1e-0c2b8d6e4f10.local", Port: 46244, Type: "host"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseICECandidate(tt.line)
+			if err != nil {
+				t.Fatalf("parseICECandidate(%q): %v", tt.line, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseICECandidate(%q)\n got %+v\nwant %+v", tt.line, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseICECandidateRejects(t *testing.T) {
+	for _, line := range []string{
+		"",
+		"a=end-of-candidates",
+		"candidate:1 1 udp 2122260223 192.168.0.196 46243 host",
+		"candidate:1 1 udp 2122260223 192.168.0.196 46243 typ",
+		"candidate:1 x udp 2122260223 192.168.0.196 46243 typ host",
+		"candidate:1 1 udp 4294967296 192.168.0.196 46243 typ host",
+		"candidate:1 1 udp 2122260223 192.168.0.196 65536 typ host",
+		"candidate:1 1 udp 2122260223 2001:db8::1 -1 typ host",
+	} {
+		if cand, err := parseICECandidate(line); err == nil {
+			t.Errorf("parseICECandidate(%q) = %+v, want error", line, cand)
+		}
+	}
+}
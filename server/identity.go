@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// External identities. By default every join gets a generated C-<hex> cid.
+// A deployment with its own users can instead have a verified join carry
+// the user's ID as its cid, so downstream systems (the event stream, logs,
+// the admin API) can tie participants to users. The ID comes from either
+//
+//   - a "cid" claim in the join JWT (AUTH_JWT_SECRET), or
+//   - the IDENTITY_HEADER request header, set by an authenticating gateway.
+//     It is only read from connections that arrive through TRUSTED_PROXIES.
+//
+// The JWT claim wins when both are present. A verified identity holds at
+// most one seat per room: a second join with it, once admitted, replaces
+// the first and keeps its host role.
+
+// Longest accepted external cid
+const maxExternalCIDLength = 64
+
+func identityHeader() string {
+	return strings.TrimSpace(os.Getenv("IDENTITY_HEADER"))
+}
+
+// headerIdentity returns the identity a trusted gateway asserted for r,
+// or "" if there is none or r didn't come through a trusted proxy.
+func headerIdentity(r *http.Request) string {
+	name := identityHeader()
+	if name == "" {
+		return ""
+	}
+	remoteIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remoteIP = r.RemoteAddr
+	}
+	if !isTrustedProxy(remoteIP, loadTrustedProxies()) {
+		return ""
+	}
+	return strings.TrimSpace(r.Header.Get(name))
+}
+
+// validExternalCID reports whether id can be used as a cid: 1-64 ASCII
+// letters, digits or ._:@- (so it needs no escaping in JSON or logs), and
+// not starting with "C-", which generated cids own.
+func validExternalCID(id string) bool {
+	if id == "" || len(id) > maxExternalCIDLength || strings.HasPrefix(id, "C-") {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		ch := id[i]
+		switch {
+		case ch >= 'a' && ch <= 'z', ch >= 'A' && ch <= 'Z', ch >= '0' && ch <= '9':
+		case ch == '.' || ch == '_' || ch == ':' || ch == '@' || ch == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// memberWithCID returns the participant or observer holding cid, or nil.
+// Caller must hold room.mu.
+func (r *Room) memberWithCID(cid string) *Client {
+	for client, held := range r.Participants {
+		if held == cid {
+			return client
+		}
+	}
+	for client, held := range r.Observers {
+		if held == cid {
+			return client
+		}
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestValidExternalCID(t *testing.T) {
+	tests := []struct {
+		id   string
+		want bool
+	}{
+		{"alice", true},
+		{"user-42", true},
+		{"alice@example.com", true},
+		{"tenant:a.b_c", true},
+		{strings.Repeat("a", maxExternalCIDLength), true},
+		{"", false},
+		{strings.Repeat("a", maxExternalCIDLength+1), false},
+		{"C-1234", false},
+		{"alice bob", false},
+		{"alice/bob", false},
+		{`al"ice`, false},
+		{"alicé", false},
+	}
+	for _, tt := range tests {
+		if got := validExternalCID(tt.id); got != tt.want {
+			t.Errorf("validExternalCID(%q) = %v, want %v", tt.id, got, tt.want)
+		}
+	}
+}
+
+// withTrustedProxies makes loadTrustedProxies read raw, and re-read the
+// environment once the test is done.
+func withTrustedProxies(t *testing.T, raw string) {
+	t.Helper()
+	t.Setenv("TRUSTED_PROXIES", raw)
+	trustedProxiesOnce = sync.Once{}
+	t.Cleanup(func() { trustedProxiesOnce = sync.Once{} })
+}
+
+// Anyone can send the header, so it only counts through a trusted proxy.
+func TestHeaderIdentityTrustedProxiesOnly(t *testing.T) {
+	t.Setenv("IDENTITY_HEADER", "X-User-Id")
+	withTrustedProxies(t, "10.0.0.0/8")
+
+	request := func(remoteAddr string) string {
+		r := httptest.NewRequest("GET", "/ws", nil)
+		r.RemoteAddr = remoteAddr
+		r.Header.Set("X-User-Id", " alice ")
+		return headerIdentity(r)
+	}
+	if got := request("10.1.2.3:5000"); got != "alice" {
+		t.Errorf("identity via trusted proxy = %q, want alice", got)
+	}
+	if got := request("203.0.113.5:5000"); got != "" {
+		t.Errorf("identity from untrusted peer = %q, want none", got)
+	}
+
+	t.Setenv("IDENTITY_HEADER", "")
+	if got := request("10.1.2.3:5000"); got != "" {
+		t.Errorf("identity without IDENTITY_HEADER = %q, want none", got)
+	}
+}
+
+func TestJoinTokenCIDClaim(t *testing.T) {
+	t.Setenv("AUTH_JWT_SECRET", "test-jwt-secret")
+	h := newTestHub(t)
+	rid := newTestRoomID(t)
+	join := func(c *Client, cid string) {
+		token, err := signJoinToken(joinClaims{Sub: "user-1", RID: rid, Exp: time.Now().Add(time.Minute).Unix(), CID: cid})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sendJSON(h, c, `{"v":1,"type":"join","rid":%q,"payload":{"token":%q}}`, rid, token)
+	}
+
+	c := newTestClient(h)
+	join(c, "alice")
+	if joined := nextOfType(t, c, "joined"); joined.CID != "alice" {
+		t.Fatalf("joined as %q, want the token's cid alice", joined.CID)
+	}
+
+	bad := newTestClient(h)
+	join(bad, "C-forged")
+	assertErrorCode(t, bad, ErrUnauthorized)
+}
+
+// identityClient is a test client a trusted gateway vouched for as id.
+func identityClient(h *Hub, id string) *Client {
+	c := newTestClient(h)
+	c.identity = id
+	return c
+}
+
+// A second session of an identity takes over the first one's seat, host
+// role included.
+func TestIdentityReplacesSessionKeepsHost(t *testing.T) {
+	h := newTestHub(t)
+	rid := newTestRoomID(t)
+
+	first := identityClient(h, "alice")
+	joinTestRoom(t, h, first, rid)
+	peer := newTestClient(h)
+	joinTestRoom(t, h, peer, rid)
+	drain(first)
+	drain(peer)
+
+	second := identityClient(h, "alice")
+	payload := joinTestRoom(t, h, second, rid)
+	if payload["hostCid"] != "alice" {
+		t.Fatalf("hostCid = %v after the host's second session joined, want alice", payload["hostCid"])
+	}
+	if n := len(payload["participants"].([]any)); n != 2 {
+		t.Fatalf("%d participants, want 2", n)
+	}
+
+	nextOfType(t, first, "session_replaced")
+	left := nextOfType(t, peer, "participant_left")
+	var departure Departure
+	if err := json.Unmarshal(left.Payload, &departure); err != nil {
+		t.Fatal(err)
+	}
+	if departure.CID != "alice" {
+		t.Fatalf("participant_left for %q, want alice", departure.CID)
+	}
+	nextOfType(t, peer, "participant_joined")
+
+	room, _ := h.rooms.get(rid)
+	if holder := func() *Client {
+		room.mu.Lock()
+		defer room.mu.Unlock()
+		return room.memberWithCID("alice")
+	}(); holder != second {
+		t.Fatal("alice's seat isn't held by the second session")
+	}
+}
+
+// A second session that's turned away leaves the first one in its seat.
+func TestRejectedIdentityJoinKeepsSession(t *testing.T) {
+	h := newTestHub(t)
+	h.nicknamePolicy = nicknamePolicyReject
+	rid := newTestRoomID(t)
+
+	first := identityClient(h, "alice")
+	joinTestRoom(t, h, first, rid)
+	peer := newTestClient(h)
+	sendJSON(h, peer, `{"v":1,"type":"join","rid":%q,"payload":{"displayName":"Bob"}}`, rid)
+	nextOfType(t, peer, "joined")
+	drain(first)
+	drain(peer)
+
+	tests := []struct {
+		name    string
+		payload string
+		code    ErrorCode
+	}{
+		{"unknown role", `{"role":"admin"}`, ErrBadRequest},
+		{"name taken", `{"displayName":"Bob"}`, ErrNameTaken},
+	}
+	for _, tt := range tests {
+		second := identityClient(h, "alice")
+		sendJSON(h, second, `{"v":1,"type":"join","rid":%q,"payload":%s}`, rid, tt.payload)
+		assertErrorCode(t, second, tt.code)
+		for _, c := range []*Client{first, peer} {
+			select {
+			case out := <-c.send:
+				t.Fatalf("%s: rejected join sent %s", tt.name, out.data)
+			default:
+			}
+		}
+		if rooms := first.memberships(); rooms[rid] != "alice" {
+			t.Fatalf("%s: first session's rooms = %v, want it still in %s", tt.name, rooms, rid)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+// Structural limits on incoming messages, checked with a streaming scan
+// before anything is unmarshaled. Real messages are a few levels deep with
+// a handful of keys; these bounds stop a small but deeply nested or
+// key-heavy document from costing far more to decode than its size suggests.
+const (
+	maxJSONDepth = 16
+	maxJSONKeys  = 256 // object keys, summed over the whole document
+)
+
+var (
+	errJSONTooDeep     = errors.New("json: nesting too deep")
+	errJSONTooManyKeys = errors.New("json: too many keys")
+)
+
+// checkJSONLimits scans data token by token and fails as soon as it
+// exceeds maxJSONDepth or maxJSONKeys. Syntax errors are returned as-is.
+func checkJSONLimits(data []byte) error {
+	type frame struct {
+		object  bool
+		wantKey bool // next token in this object is a key
+	}
+	var stack []frame
+	keys := 0
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		delim, isDelim := tok.(json.Delim)
+		if isDelim && (delim == '}' || delim == ']') {
+			stack = stack[:len(stack)-1]
+			continue
+		}
+		if n := len(stack); n > 0 && stack[n-1].object {
+			if stack[n-1].wantKey {
+				keys++
+				if keys > maxJSONKeys {
+					return errJSONTooManyKeys
+				}
+				stack[n-1].wantKey = false
+				continue
+			}
+			stack[n-1].wantKey = true
+		}
+		if isDelim {
+			if len(stack) >= maxJSONDepth {
+				return errJSONTooDeep
+			}
+			stack = append(stack, frame{object: delim == '{', wantKey: delim == '{'})
+		}
+	}
+}
+
+// decodeMessage parses an envelope, rejecting fields the protocol doesn't
+// define. The payload is kept raw.
+func decodeMessage(data []byte, msg *Message) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(msg)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// Every envelope field the protocol documents is accepted; anything else
+// is a BAD_REQUEST.
+func TestDecodeMessageEnvelopeFields(t *testing.T) {
+	var msg Message
+	if err := decodeMessage([]byte(`{"v":1,"type":"ping","rid":"r","sid":"s","cid":"c","to":"t","ts":1735171200000,"payload":{"ts":1}}`), &msg); err != nil {
+		t.Fatalf("documented envelope rejected: %v", err)
+	}
+	if msg.Ts != 1735171200000 {
+		t.Errorf("ts = %d, want 1735171200000", msg.Ts)
+	}
+	if err := decodeMessage([]byte(`{"v":1,"type":"ping","bogus":1}`), &msg); err == nil {
+		t.Error("unknown envelope field accepted")
+	}
+
+	h := newTestHub(t)
+	c := newTestClient(h)
+	sendJSON(h, c, `{"v":1,"type":"ping","ts":1735171200000,"payload":{"ts":1735171200000}}`)
+	nextOfType(t, c, "pong")
+	sendJSON(h, c, `{"v":1,"type":"ping","bogus":1}`)
+	if msg := nextOfType(t, c, "error"); !strings.Contains(string(msg.Payload), string(ErrBadRequest)) {
+		t.Errorf("unknown envelope field: got %s, want %s", msg.Payload, ErrBadRequest)
+	}
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"crypto/tls"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/joho/godotenv"
@@ -12,34 +15,32 @@ import (
 
 func main() {
 	// Load .env from current directory or parent directory (for local dev)
-	_ = godotenv.Load()
-	_ = godotenv.Load("../.env")
+	for _, path := range dotenvFiles {
+		_ = godotenv.Load(path)
+	}
+
+	loadKeepaliveConfig()
+	loadBufferConfig()
+	loadMessageSizeLimits()
+	loadAllowedOrigins()
+
+	// SIGHUP reloads the origin allow-list without dropping connections
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			loadAllowedOrigins()
+		}
+	}()
 
 	// Initialize signaling
 	hub := newHub()
-	go hub.run()
-
-	// Simple CORS middleware for API
-	enableCors := func(h http.HandlerFunc) http.HandlerFunc {
-		return func(w http.ResponseWriter, r *http.Request) {
-			if !isOriginAllowed(r) {
-				http.Error(w, "Forbidden", http.StatusForbidden)
-				return
-			}
-			origin := r.Header.Get("Origin")
-			if origin != "" {
-				w.Header().Set("Access-Control-Allow-Origin", origin)
-				w.Header().Set("Vary", "Origin")
-			}
-			if r.Method == "OPTIONS" {
-				w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-				w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Turn-Token")
-				w.WriteHeader(http.StatusNoContent)
-				return
-			}
-			h(w, r)
+	if hub.stateFile != "" {
+		if err := hub.loadState(hub.stateFile); err != nil {
+			log.Printf("[STATE] Failed to load %s: %v", hub.stateFile, err)
 		}
 	}
+	go hub.run()
 
 	// Rate Limiters
 	// WS: 10 connections per minute per IP
@@ -47,12 +48,26 @@ func main() {
 	wsBlockMode := strings.TrimSpace(os.Getenv("BLOCK_WEBSOCKET"))
 	wsHang := strings.EqualFold(wsBlockMode, "hang")
 	wsBlocked := !wsHang && strings.EqualFold(wsBlockMode, "block")
+	// Poll: 10 new sessions per minute per IP
+	pollLimiter := NewIPLimiter(10.0/60.0, 5)
+
+	// TURN credentials: each issuance grants relay capacity, so this bucket is
+	// separate and tunable (TURN_CREDS_PER_MINUTE / TURN_CREDS_BURST)
+	turnCredsPerMinute := float64(max(1, envInt("TURN_CREDS_PER_MINUTE", 5)))
+	turnCredsBurst := float64(max(1, envInt("TURN_CREDS_BURST", 5)))
+	turnCredsLimiter := NewIPLimiter(turnCredsPerMinute/60.0, turnCredsBurst)
 
 	// API: 5 requests per minute per IP
-	turnCredsLimiter := NewIPLimiter(5.0/60.0, 5)
 	diagnosticLimiter := NewIPLimiter(5.0/60.0, 5)
+	iceCheckLimiter := NewIPLimiter(5.0/60.0, 5)
 	// Room ID: 30 requests per minute per IP
 	roomIDLimiter := NewIPLimiter(30.0/60.0, 10)
+	// Room info: 30 requests per minute per IP
+	roomInfoLimiter := NewIPLimiter(30.0/60.0, 10)
+	// Admin: 30 requests per minute per IP
+	adminLimiter := NewIPLimiter(30.0/60.0, 10)
+	// Self-test: 6 runs per minute per IP, ample for an uptime monitor
+	selftestLimiter := NewIPLimiter(6.0/60.0, 3)
 
 	http.HandleFunc("/ws", rateLimitMiddleware(wsLimiter, func(w http.ResponseWriter, r *http.Request) {
 		if wsHang {
@@ -66,25 +81,74 @@ func main() {
 		serveWs(hub, w, r)
 	}))
 
-	http.HandleFunc("/api/turn-credentials", rateLimitMiddleware(turnCredsLimiter, enableCors(handleTurnCredentials())))
-	http.HandleFunc("/api/diagnostic-token", rateLimitMiddleware(diagnosticLimiter, enableCors(handleDiagnosticToken())))
-	http.HandleFunc("/api/room-id", rateLimitMiddleware(roomIDLimiter, enableCors(handleRoomID())))
+	http.HandleFunc("/poll", corsMiddleware(servePoll(hub, pollLimiter)))
 
-	http.HandleFunc("/device-check", handleDeviceCheck)
+	// All API endpoints get the same CORS handling. CORS runs first so that
+	// preflight requests don't consume rate limit tokens.
+	handleAPI := func(pattern string, limiter *IPLimiter, h http.HandlerFunc) {
+		http.HandleFunc(pattern, corsMiddleware(rateLimitMiddleware(limiter, h)))
+	}
+	// DIAGNOSTICS_ENABLED=false leaves the diagnostics page and its token
+	// endpoint unregistered (404) in hardened deployments
+	diagnosticsEnabled := envBool("DIAGNOSTICS_ENABLED", true)
+
+	handleAPI("/api/turn-credentials", turnCredsLimiter, handleTurnCredentials())
+	if diagnosticsEnabled {
+		handleAPI("/api/diagnostic-token", diagnosticLimiter, handleDiagnosticToken())
+	}
+	handleAPI("/api/ice-check", iceCheckLimiter, handleICECheck())
+	handleAPI("/api/room-id", roomIDLimiter, handleRoomID())
+	handleAPI("/api/rooms/{rid}", roomInfoLimiter, handleRoomInfo(hub))
+	handleAPI("/api/stats", adminLimiter, handleStats(hub))
+	handleAPI("/api/admin/close-room", adminLimiter, handleCloseRoom(hub))
+	handleAPI("/api/admin/kick-sid", adminLimiter, handleKickSID(hub))
+	handleAPI("/api/admin/turn-secret", adminLimiter, handleRotateTurnSecret())
+	handleAPI("/api/selftest", selftestLimiter, handleSelftest(hub))
+
+	if diagnosticsEnabled {
+		http.HandleFunc("/device-check", handleDeviceCheck)
+	} else {
+		log.Printf("[CONFIG] Diagnostics page disabled")
+	}
+
+	// Server-to-server only; not CORS-enabled
+	http.HandleFunc("/internal/subscribe", handleInternalSubscribe(hub))
 
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
 	}
+	addr := strings.TrimSpace(os.Getenv("LISTEN_ADDR"))
+	if addr == "" {
+		addr = ":" + port
+	}
+
+	// TLS is optional; behind a reverse proxy the server stays plaintext
+	tlsCert := strings.TrimSpace(os.Getenv("TLS_CERT"))
+	tlsKey := strings.TrimSpace(os.Getenv("TLS_KEY"))
+	if (tlsCert == "") != (tlsKey == "") {
+		log.Fatal("TLS_CERT and TLS_KEY must be set together")
+	}
 
-	log.Printf("Server executing on :%s", port)
 	server := &http.Server{
-		Addr:              ":" + port,
+		Addr:              addr,
+		Handler:           withRequestID(http.DefaultServeMux),
 		ReadHeaderTimeout: 5 * time.Second,
 		ReadTimeout:       15 * time.Second,
 		WriteTimeout:      15 * time.Second,
 		IdleTimeout:       60 * time.Second,
 	}
+
+	if tlsCert != "" {
+		server.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		log.Printf("Server executing on %s (TLS)", addr)
+		if err := server.ListenAndServeTLS(tlsCert, tlsKey); err != nil {
+			log.Fatal("ListenAndServeTLS: ", err)
+		}
+		return
+	}
+
+	log.Printf("Server executing on %s", addr)
 	if err := server.ListenAndServe(); err != nil {
 		log.Fatal("ListenAndServe: ", err)
 	}
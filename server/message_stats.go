@@ -0,0 +1,51 @@
+package main
+
+import "sync/atomic"
+
+// Client message types counted individually in /api/stats. Anything else
+// is counted as "other", which keeps the set bounded.
+var countedMessageTypes = [...]string{
+	"join", "leave", "end_room", "hello", "watch_rooms", "promote",
+	"set_label", "request_mute", "broadcast", "ping", "get_state", "data",
+	"conn_state", "offer", "answer", "ice", "renegotiate", "sealed", "other",
+}
+
+var messageTypeIndex = func() map[string]int {
+	idx := make(map[string]int, len(countedMessageTypes))
+	for i, t := range countedMessageTypes {
+		idx[t] = i
+	}
+	return idx
+}()
+
+// messageCounters counts messages received from clients, and their bytes
+// on the wire, by type. Safe for concurrent use.
+type messageCounters struct {
+	count [len(countedMessageTypes)]atomic.Int64
+	bytes [len(countedMessageTypes)]atomic.Int64
+}
+
+type messageTypeStats struct {
+	Count int64 `json:"count"`
+	Bytes int64 `json:"bytes"`
+}
+
+func (m *messageCounters) add(msgType string, size int) {
+	i, ok := messageTypeIndex[msgType]
+	if !ok {
+		i = messageTypeIndex["other"]
+	}
+	m.count[i].Add(1)
+	m.bytes[i].Add(int64(size))
+}
+
+// snapshot returns the counters of every type seen at least once.
+func (m *messageCounters) snapshot() map[string]messageTypeStats {
+	stats := make(map[string]messageTypeStats)
+	for i, t := range countedMessageTypes {
+		if n := m.count[i].Load(); n > 0 {
+			stats[t] = messageTypeStats{Count: n, Bytes: m.bytes[i].Load()}
+		}
+	}
+	return stats
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Clients that negotiate the serenada-bin subprotocol exchange the same
+// messages as MessagePack in binary frames. Outgoing envelopes are encoded
+// straight to MessagePack; incoming frames and relayed payloads, which the
+// hub handles as JSON, are converted at the transport boundary. Only the
+// subset of MessagePack that maps onto JSON is supported (no ext types,
+// string map keys).
+const subprotocolBinary = "serenada-bin"
+
+// Nesting limit for decoded values; real messages are a few levels deep
+const msgpackMaxDepth = 32
+
+var errMsgpackTruncated = errors.New("msgpack: unexpected end of data")
+
+// envelopeKeys names the envelope fields on the wire.
+type envelopeKeys struct {
+	v, typ, rid, sid, cid, to, seq, from, payload string
+}
+
+var (
+	messageKeys = envelopeKeys{"v", "type", "rid", "sid", "cid", "to", "seq", "from", "payload"}
+	compactKeys = envelopeKeys{"v", "t", "r", "s", "c", "o", "q", "f", "p"} // see compactMessage
+)
+
+// appendMsgpackMessage appends m as a MessagePack map, leaving out empty
+// optional fields like the JSON encoding does. The payload is raw JSON and
+// is converted without decoding it into Go values.
+func appendMsgpackMessage(dst []byte, m Message, keys *envelopeKeys) ([]byte, error) {
+	n := 2
+	for _, s := range [...]string{m.RID, m.SID, m.CID, m.To, m.From} {
+		if s != "" {
+			n++
+		}
+	}
+	if m.Seq != 0 {
+		n++
+	}
+	if len(m.Payload) > 0 {
+		n++
+	}
+	dst = appendMsgpackLen(dst, n, 0x80, 15, 0, 0xde, 0xdf)
+
+	dst = appendMsgpackString(dst, keys.v)
+	dst = appendMsgpackInt(dst, int64(m.V))
+	dst = appendMsgpackString(dst, keys.typ)
+	dst = appendMsgpackString(dst, m.Type)
+	dst = appendMsgpackField(dst, keys.rid, m.RID)
+	dst = appendMsgpackField(dst, keys.sid, m.SID)
+	dst = appendMsgpackField(dst, keys.cid, m.CID)
+	dst = appendMsgpackField(dst, keys.to, m.To)
+	if m.Seq != 0 {
+		dst = appendMsgpackString(dst, keys.seq)
+		dst = appendMsgpackInt(dst, m.Seq)
+	}
+	dst = appendMsgpackField(dst, keys.from, m.From)
+	if len(m.Payload) > 0 {
+		dst = appendMsgpackString(dst, keys.payload)
+		return appendJSONAsMsgpack(dst, m.Payload)
+	}
+	return dst, nil
+}
+
+// appendMsgpackField appends a string field unless it is empty.
+func appendMsgpackField(dst []byte, key, value string) []byte {
+	if value == "" {
+		return dst
+	}
+	return appendMsgpackString(appendMsgpackString(dst, key), value)
+}
+
+// jsonToMsgpack re-encodes a JSON document as MessagePack.
+func jsonToMsgpack(data []byte) ([]byte, error) {
+	return appendJSONAsMsgpack(nil, data)
+}
+
+// appendJSONAsMsgpack appends the MessagePack form of a single JSON
+// document, converting token by token.
+func appendJSONAsMsgpack(dst []byte, data []byte) ([]byte, error) {
+	s := jsonToMsgpackScanner{data: data, out: dst}
+	if err := s.value(0); err != nil {
+		return nil, err
+	}
+	s.skipSpace()
+	if s.pos != len(s.data) {
+		return nil, errors.New("json: trailing data")
+	}
+	return s.out, nil
+}
+
+// msgpackToJSON decodes a single MessagePack value and re-encodes it as JSON.
+func msgpackToJSON(data []byte) ([]byte, error) {
+	d := msgpackDecoder{data: data}
+	v, err := d.decode(0)
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(d.data) {
+		return nil, errors.New("msgpack: trailing data")
+	}
+	return json.Marshal(v)
+}
+
+var errJSONSyntax = errors.New("json: invalid document")
+
+type jsonToMsgpackScanner struct {
+	data []byte
+	pos  int
+	out  []byte
+}
+
+func (s *jsonToMsgpackScanner) skipSpace() {
+	for s.pos < len(s.data) {
+		switch s.data[s.pos] {
+		case ' ', '\t', '\n', '\r':
+			s.pos++
+		default:
+			return
+		}
+	}
+}
+
+// consume skips whitespace and reports whether the next byte is c,
+// stepping over it if so.
+func (s *jsonToMsgpackScanner) consume(c byte) bool {
+	s.skipSpace()
+	if s.pos < len(s.data) && s.data[s.pos] == c {
+		s.pos++
+		return true
+	}
+	return false
+}
+
+func (s *jsonToMsgpackScanner) value(depth int) error {
+	if depth > msgpackMaxDepth {
+		return errors.New("json: nesting too deep")
+	}
+	s.skipSpace()
+	if s.pos >= len(s.data) {
+		return errJSONSyntax
+	}
+	switch c := s.data[s.pos]; {
+	case c == '{':
+		s.pos++
+		return s.container(depth, '}', true)
+	case c == '[':
+		s.pos++
+		return s.container(depth, ']', false)
+	case c == '"':
+		return s.str()
+	case c == 't':
+		return s.literal("true", 0xc3)
+	case c == 'f':
+		return s.literal("false", 0xc2)
+	case c == 'n':
+		return s.literal("null", 0xc0)
+	default:
+		return s.number()
+	}
+}
+
+// container converts the members of an object or array. The element count
+// is only known at the end, so the header is inserted in front of them then.
+func (s *jsonToMsgpackScanner) container(depth int, end byte, object bool) error {
+	start := len(s.out)
+	n := 0
+	if !s.consume(end) {
+		for {
+			if object {
+				s.skipSpace()
+				if s.pos >= len(s.data) || s.data[s.pos] != '"' {
+					return errJSONSyntax
+				}
+				if err := s.str(); err != nil {
+					return err
+				}
+				if !s.consume(':') {
+					return errJSONSyntax
+				}
+			}
+			if err := s.value(depth + 1); err != nil {
+				return err
+			}
+			n++
+			if s.consume(',') {
+				continue
+			}
+			if s.consume(end) {
+				break
+			}
+			return errJSONSyntax
+		}
+	}
+
+	var buf [5]byte
+	var header []byte
+	if object {
+		header = appendMsgpackLen(buf[:0], n, 0x80, 15, 0, 0xde, 0xdf)
+	} else {
+		header = appendMsgpackLen(buf[:0], n, 0x90, 15, 0, 0xdc, 0xdd)
+	}
+	s.out = append(s.out, header...)
+	copy(s.out[start+len(header):], s.out[start:])
+	copy(s.out[start:], header)
+	return nil
+}
+
+// str converts a string, copying it as-is unless it has escapes or
+// invalid UTF-8, which encoding/json resolves like it always did.
+func (s *jsonToMsgpackScanner) str() error {
+	start := s.pos
+	plain := true
+	for s.pos++; s.pos < len(s.data); s.pos++ {
+		switch c := s.data[s.pos]; {
+		case c == '\\':
+			plain = false
+			s.pos++
+		case c == '"':
+			s.pos++
+			raw := s.data[start+1 : s.pos-1]
+			if plain && utf8.Valid(raw) {
+				s.out = appendMsgpackLen(s.out, len(raw), 0xa0, 31, 0xd9, 0xda, 0xdb)
+				s.out = append(s.out, raw...)
+				return nil
+			}
+			var v string
+			if err := json.Unmarshal(s.data[start:s.pos], &v); err != nil {
+				return err
+			}
+			s.out = appendMsgpackString(s.out, v)
+			return nil
+		case c < 0x20:
+			return errJSONSyntax
+		}
+	}
+	return errJSONSyntax
+}
+
+func (s *jsonToMsgpackScanner) literal(word string, op byte) error {
+	if !bytes.HasPrefix(s.data[s.pos:], []byte(word)) {
+		return errJSONSyntax
+	}
+	s.pos += len(word)
+	s.out = append(s.out, op)
+	return nil
+}
+
+// number converts integers that fit in int64 to MessagePack ints and
+// everything else to float64.
+func (s *jsonToMsgpackScanner) number() error {
+	start := s.pos
+	for s.pos < len(s.data) && strings.IndexByte("+-.0123456789eE", s.data[s.pos]) >= 0 {
+		s.pos++
+	}
+	if !json.Valid(s.data[start:s.pos]) {
+		return errJSONSyntax
+	}
+	num := string(s.data[start:s.pos])
+	if i, err := strconv.ParseInt(num, 10, 64); err == nil {
+		s.out = appendMsgpackInt(s.out, i)
+		return nil
+	}
+	f, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return err
+	}
+	s.out = append(s.out, 0xcb)
+	s.out = binary.BigEndian.AppendUint64(s.out, math.Float64bits(f))
+	return nil
+}
+
+func appendMsgpackInt(dst []byte, i int64) []byte {
+	switch {
+	case i >= 0 && i <= 0x7f:
+		return append(dst, byte(i))
+	case i < 0 && i >= -32:
+		return append(dst, byte(int8(i)))
+	case i >= math.MinInt32 && i <= math.MaxInt32:
+		return binary.BigEndian.AppendUint32(append(dst, 0xd2), uint32(int32(i)))
+	default:
+		return binary.BigEndian.AppendUint64(append(dst, 0xd3), uint64(i))
+	}
+}
+
+func appendMsgpackString(dst []byte, s string) []byte {
+	dst = appendMsgpackLen(dst, len(s), 0xa0, 31, 0xd9, 0xda, 0xdb)
+	return append(dst, s...)
+}
+
+// appendMsgpackLen appends a container/string header, using the fix form
+// when n fits in fixMax. op8 may be 0 for types without an 8-bit form.
+func appendMsgpackLen(dst []byte, n int, fix byte, fixMax int, op8, op16, op32 byte) []byte {
+	switch {
+	case n <= fixMax:
+		return append(dst, fix|byte(n))
+	case op8 != 0 && n <= math.MaxUint8:
+		return append(dst, op8, byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(dst, op16), uint16(n))
+	default:
+		return binary.BigEndian.AppendUint32(append(dst, op32), uint32(n))
+	}
+}
+
+type msgpackDecoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *msgpackDecoder) next(n int) ([]byte, error) {
+	if n < 0 || n > len(d.data)-d.pos {
+		return nil, errMsgpackTruncated
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *msgpackDecoder) uint(size int) (uint64, error) {
+	b, err := d.next(size)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
+
+func (d *msgpackDecoder) decode(depth int) (interface{}, error) {
+	if depth > msgpackMaxDepth {
+		return nil, errors.New("msgpack: nesting too deep")
+	}
+	b, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	op := b[0]
+	switch {
+	case op <= 0x7f:
+		return int64(op), nil
+	case op >= 0xe0:
+		return int64(int8(op)), nil
+	case op&0xf0 == 0x80:
+		return d.decodeMap(int(op&0x0f), depth)
+	case op&0xf0 == 0x90:
+		return d.decodeArray(int(op&0x0f), depth)
+	case op&0xe0 == 0xa0:
+		return d.decodeString(int(op & 0x1f))
+	}
+
+	switch op {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xd9: // bin8, str8
+		n, err := d.uint(1)
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeString(int(n))
+	case 0xc5, 0xda: // bin16, str16
+		n, err := d.uint(2)
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeString(int(n))
+	case 0xc6, 0xdb: // bin32, str32
+		n, err := d.uint(4)
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeString(int(n))
+	case 0xca:
+		v, err := d.uint(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(uint32(v))), nil
+	case 0xcb:
+		v, err := d.uint(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(v), nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		return d.uint(1 << (op - 0xcc))
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (op - 0xd0)
+		v, err := d.uint(size)
+		if err != nil {
+			return nil, err
+		}
+		// Sign-extend from the encoded width
+		shift := 64 - 8*size
+		return int64(v<<shift) >> shift, nil
+	case 0xdc, 0xdd:
+		n, err := d.uint(2 << (op - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeArray(int(n), depth)
+	case 0xde, 0xdf:
+		n, err := d.uint(2 << (op - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeMap(int(n), depth)
+	}
+	return nil, fmt.Errorf("msgpack: unsupported type 0x%02x", op)
+}
+
+func (d *msgpackDecoder) decodeString(n int) (interface{}, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (d *msgpackDecoder) decodeArray(n int, depth int) (interface{}, error) {
+	// Every element takes at least one byte
+	if n > len(d.data)-d.pos {
+		return nil, errMsgpackTruncated
+	}
+	arr := make([]interface{}, 0, n)
+	for i := 0; i < n; i++ {
+		v, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		arr = append(arr, v)
+	}
+	return arr, nil
+}
+
+func (d *msgpackDecoder) decodeMap(n int, depth int) (interface{}, error) {
+	if n > (len(d.data)-d.pos)/2 {
+		return nil, errMsgpackTruncated
+	}
+	m := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		k, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			return nil, errors.New("msgpack: map key is not a string")
+		}
+		v, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		m[key] = v
+	}
+	return m, nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var msgpackTestMessage = Message{
+	V:       1,
+	Type:    "ice",
+	RID:     "Qm9vdHN0cmFwUm9vbUlEVGVzdA",
+	CID:     "C-6410fd5a9574ea8e",
+	Seq:     4242,
+	Payload: json.RawMessage(`{"from":"C-61e2838bcf1cfaab","candidate":{"candidate":"candidate:842163049 1 udp 1677729535 203.0.113.7 54321 typ srflx raddr 10.0.0.2 rport 54321","sdpMid":"0","sdpMLineIndex":0,"usernameFragment":"EsAw"}}`),
+}
+
+// assertSameJSON fails unless a and b decode to the same value.
+func assertSameJSON(t *testing.T, got, want []byte) {
+	t.Helper()
+	var gotV, wantV interface{}
+	if err := json.Unmarshal(got, &gotV); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(want, &wantV); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotV, wantV) {
+		t.Errorf("decoded %s\nwant    %s", got, want)
+	}
+}
+
+// Encoding a Message directly must give what encoding its JSON gives.
+func TestAppendMsgpackMessage(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		keys *envelopeKeys
+		json interface{}
+	}{
+		{"full", &messageKeys, msgpackTestMessage},
+		{"compact", &compactKeys, compactMessage{
+			V: msgpackTestMessage.V, Type: msgpackTestMessage.Type, RID: msgpackTestMessage.RID,
+			CID: msgpackTestMessage.CID, Seq: msgpackTestMessage.Seq, Payload: msgpackTestMessage.Payload,
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			packed, err := appendMsgpackMessage(nil, msgpackTestMessage, tt.keys)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := msgpackToJSON(packed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := json.Marshal(tt.json)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertSameJSON(t, got, want)
+		})
+	}
+}
+
+func TestJSONToMsgpack(t *testing.T) {
+	long := strings.Repeat("x", 300)
+	many := "[" + strings.Repeat("1,", 20) + "1]"
+	for _, doc := range []string{
+		`null`, `true`, `false`, `0`, `-1`, `-33`, `127`, `128`, `70000`, `-70000`,
+		`9007199254740993`, `-9223372036854775808`, `1.5`, `-2.5e-3`, `18446744073709551616`,
+		`""`, `"plain"`, `"tab\tnewline\n quote\" slash\/ é 😀"`, `"from"`, `"é 😀"`,
+		`"` + long + `"`, `{}`, `[]`, many, ` { "a" : [ 1 , { "b" : null } ] , "c" : "d" } `,
+		`{"` + long + `":[[],[{}]]}`, `{"a":1,"a":2}`,
+	} {
+		got, err := jsonToMsgpack([]byte(doc))
+		if err != nil {
+			t.Errorf("jsonToMsgpack(%s): %v", doc, err)
+			continue
+		}
+		back, err := msgpackToJSON(got)
+		if err != nil {
+			t.Errorf("msgpackToJSON(jsonToMsgpack(%s)): %v", doc, err)
+			continue
+		}
+		assertSameJSON(t, back, []byte(doc))
+	}
+
+	for _, doc := range []string{
+		``, `nul`, `tru`, `{`, `[1,]`, `[1 2]`, `{"a"}`, `{"a":}`, `{1:2}`, `"open`, "\"ctl\x01\"",
+		`1e400`, `-`, `01`, `1.`, `+1`, `{} {}`, `[` + strings.Repeat(`[`, msgpackMaxDepth+1) + strings.Repeat(`]`, msgpackMaxDepth+2),
+	} {
+		if got, err := jsonToMsgpack([]byte(doc)); err == nil {
+			t.Errorf("jsonToMsgpack(%q) = %x, want error", doc, got)
+		}
+	}
+}
+
+func BenchmarkEncodeMessage(b *testing.B) {
+	b.Run("json", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			json.Marshal(msgpackTestMessage)
+		}
+	})
+	b.Run("msgpack", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			appendMsgpackMessage(make([]byte, 0, len(msgpackTestMessage.Payload)+128), msgpackTestMessage, &messageKeys)
+		}
+	})
+}
+
+// A serenada-bin client talks MessagePack in binary frames both ways.
+func TestBinarySubprotocol(t *testing.T) {
+	h := newTestHub(t)
+	conn, _ := dialTestWS(t, h, subprotocolBinary)
+	if conn.Subprotocol() != subprotocolBinary {
+		t.Fatalf("negotiated %q", conn.Subprotocol())
+	}
+
+	join, err := jsonToMsgpack([]byte(fmt.Sprintf(`{"v":1,"type":"join","rid":%q}`, newTestRoomID(t))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteMessage(websocket.BinaryMessage, join); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	frameType, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frameType != websocket.BinaryMessage {
+		t.Fatalf("got frame type %d, want binary", frameType)
+	}
+	decoded, err := msgpackToJSON(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg Message
+	if err := json.Unmarshal(decoded, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != "joined" || msg.CID == "" {
+		t.Fatalf("got %s, want joined with a cid", decoded)
+	}
+}
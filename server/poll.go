@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Long-polling fallback for networks where WebSocket upgrades are blocked.
+//
+//	GET  /poll          opens a session and returns {"sid": "..."}
+//	GET  /poll?sid=...  waits up to pollWait and returns queued messages as a JSON array
+//	POST /poll?sid=...  submits one signaling message
+const (
+	pollWait         = 25 * time.Second
+	pollStaleTimeout = 60 * time.Second
+	pollMaxBatch     = 64
+)
+
+func servePoll(hub *Hub, limiter *IPLimiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sid := r.URL.Query().Get("sid")
+		if sid != "" && !validSID(sid) {
+			http.Error(w, "Invalid sid", http.StatusBadRequest)
+			return
+		}
+		switch {
+		case r.Method == http.MethodGet && sid == "":
+			openPollSession(hub, limiter, w, r)
+		case r.Method == http.MethodGet:
+			pollMessages(hub, sid, w, r)
+		case r.Method == http.MethodPost:
+			submitPollMessage(hub, sid, w, r)
+		default:
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func openPollSession(hub *Hub, limiter *IPLimiter, w http.ResponseWriter, r *http.Request) {
+	ip := getClientIP(r)
+	// Only session creation is rate limited, like WebSocket connects
+	if bucket := limiter.GetLimiter(ip); !bucket.Allow() {
+		writeRateLimited(w, bucket.RetryAfter())
+		log.Printf("Rate limit exceeded for IP: %s", ip)
+		return
+	}
+	if !hub.ipConns.Acquire(ip) {
+		http.Error(w, "429 Too Many Requests", http.StatusTooManyRequests)
+		log.Printf("Connection limit exceeded for IP: %s", ip)
+		return
+	}
+
+	sid := generateID("S-")
+	client := &Client{
+		hub:       hub,
+		send:      make(chan outMessage, hub.sendBuffer),
+		sid:       sid,
+		ip:        ip,
+		transport: TransportPoll,
+		reqID:     requestID(r),
+		identity:  headerIdentity(r),
+		done:      make(chan struct{}),
+	}
+	client.lastSeen.Store(time.Now().UnixNano())
+
+	hub.clients.add(client)
+	log.Printf("[POLL] Opened session %s (req %s)", sid, client.reqID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]string{
+		"sid": sid,
+	})
+}
+
+func lookupPollClient(hub *Hub, sid string) (*Client, bool) {
+	c, ok := hub.clients.get(sid)
+	if !ok || c.transport != TransportPoll {
+		return nil, false
+	}
+	return c, true
+}
+
+func pollMessages(hub *Hub, sid string, w http.ResponseWriter, r *http.Request) {
+	c, ok := lookupPollClient(hub, sid)
+	if !ok {
+		http.Error(w, "Unknown session", http.StatusGone)
+		return
+	}
+	c.lastSeen.Store(time.Now().UnixNano())
+
+	// The server-wide WriteTimeout is shorter than a poll
+	http.NewResponseController(w).SetWriteDeadline(time.Now().Add(pollWait + writeWait))
+
+	timer := time.NewTimer(pollWait)
+	defer timer.Stop()
+
+	batch := []json.RawMessage{}
+	select {
+	case msg := <-c.send:
+		if !c.stale(msg) {
+			batch = append(batch, msg.data)
+		}
+	drain:
+		for len(batch) < pollMaxBatch {
+			select {
+			case msg := <-c.send:
+				if !c.stale(msg) {
+					batch = append(batch, msg.data)
+				}
+			default:
+				break drain
+			}
+		}
+	case <-timer.C:
+	case <-c.done:
+		http.Error(w, "Session closed", http.StatusGone)
+		return
+	case <-r.Context().Done():
+		return
+	}
+
+	// Count the time spent waiting as activity too
+	c.lastSeen.Store(time.Now().UnixNano())
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(batch)
+}
+
+func submitPollMessage(hub *Hub, sid string, w http.ResponseWriter, r *http.Request) {
+	c, ok := lookupPollClient(hub, sid)
+	if !ok {
+		http.Error(w, "Unknown session", http.StatusGone)
+		return
+	}
+	c.lastSeen.Store(time.Now().UnixNano())
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxMessageSize))
+	if err != nil {
+		http.Error(w, "Message too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	hub.handleMessage(c, body)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A session is usable as soon as its sid is handed out, and gone as soon
+// as it disconnects, without waiting on the hub's run loop.
+func TestPollSessionRegisteredBeforeReply(t *testing.T) {
+	h := newTestHub(t)
+	handler := servePoll(h, NewIPLimiter(100, 100))
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/poll", nil))
+	var opened struct{ SID string }
+	if err := json.NewDecoder(rec.Body).Decode(&opened); err != nil {
+		t.Fatal(err)
+	}
+
+	c, ok := lookupPollClient(h, opened.SID)
+	if !ok {
+		t.Fatalf("session %s not registered when its sid was returned", opened.SID)
+	}
+
+	h.disconnect(c, leaveReasonLeft)
+	if _, ok := lookupPollClient(h, opened.SID); ok {
+		t.Fatalf("session %s still registered after disconnect", opened.SID)
+	}
+}
+
+// The reaper can evict a poll client while one of its POSTs is being
+// handled. The disconnect waits for the message, and a join that lost the
+// race doesn't put the client back in a room. Run with -race.
+func TestPollEvictionDuringMessage(t *testing.T) {
+	h := newTestHub(t)
+	for i := 0; i < 50; i++ {
+		rid := newTestRoomID(t)
+		c := newTestClient(h)
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			sendJSON(h, c, `{"v":1,"type":"join","rid":%q}`, rid)
+		}()
+		go func() {
+			defer wg.Done()
+			c.closeFor(leaveReasonTimeout)
+		}()
+		wg.Wait()
+
+		// closeFor disconnects asynchronously
+		deadline := time.Now().Add(5 * time.Second)
+		for !c.disconnected.Load() {
+			if time.Now().After(deadline) {
+				t.Fatal("client never disconnected")
+			}
+			time.Sleep(time.Millisecond)
+		}
+		c.msgMu.Lock()
+		c.msgMu.Unlock()
+
+		if room, ok := h.rooms.get(rid); ok {
+			room.mu.Lock()
+			_, member := room.Participants[c]
+			room.mu.Unlock()
+			if member {
+				t.Fatalf("evicted client still in room %s", rid)
+			}
+		}
+	}
+}
@@ -0,0 +1,186 @@
+// Package protocol holds the wire types of the Serenada signaling protocol
+// v1 (serenada_protocol_v1.md), shared by the server and Go clients.
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Version is the envelope version (Message.V) this package speaks
+const Version = 1
+
+// Message types a client sends, and those only the server sends. Relayed
+// types (offer, answer, ice, ...) arrive under the same name they were sent.
+const (
+	TypeJoin      = "join"
+	TypeLeave     = "leave"
+	TypeEndRoom   = "end_room"
+	TypeHello     = "hello"
+	TypePing      = "ping"
+	TypeGetState  = "get_state"
+	TypeData      = "data"
+	TypeConnState = "conn_state"
+	TypeOffer     = "offer"
+	TypeAnswer    = "answer"
+	TypeICE       = "ice"
+	TypeSealed    = "sealed"
+
+	TypeWelcome                = "welcome"
+	TypeJoined                 = "joined"
+	TypeLeft                   = "left"
+	TypeRoomState              = "room_state"
+	TypeParticipantJoined      = "participant_joined"
+	TypeParticipantLeft        = "participant_left"
+	TypeRoomEnded              = "room_ended"
+	TypeResumeToken            = "resume_token"
+	TypePeerConnectionDegraded = "peer_connection_degraded"
+	TypePong                   = "pong"
+	TypeError                  = "error"
+)
+
+// Roles a client can request on join. Observers receive room events but
+// never publish, and don't count toward the participant cap.
+const (
+	RoleParticipant = "participant"
+	RoleObserver    = "observer"
+)
+
+// Message is the envelope every signaling message travels in.
+type Message struct {
+	V       int             `json:"v"`
+	Type    string          `json:"type"`
+	RID     string          `json:"rid,omitempty"`
+	SID     string          `json:"sid,omitempty"`
+	CID     string          `json:"cid,omitempty"`
+	To      string          `json:"to,omitempty"`
+	Ts      int64           `json:"ts,omitempty"`   // client timestamp (ms since epoch), unused by the server
+	Seq     int64           `json:"seq,omitempty"`  // per-room relay sequence, set by the server
+	From    string          `json:"from,omitempty"` // sender of a sealed relay, set by the server
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// DecodePayload unmarshals the payload into v, e.g. a *Joined for joined.
+func (m Message) DecodePayload(v any) error {
+	if len(m.Payload) == 0 {
+		return fmt.Errorf("%s message has no payload", m.Type)
+	}
+	return json.Unmarshal(m.Payload, v)
+}
+
+type Participant struct {
+	CID      string `json:"cid"`
+	JoinedAt int64  `json:"joinedAt,omitempty"`
+	Role     string `json:"role,omitempty"`
+
+	// Client-supplied, sanitized on join; clients must still escape it
+	DisplayName string `json:"displayName,omitempty"`
+
+	// Media connection state the participant last reported with conn_state.
+	// Unverified; a hint for late joiners
+	ConnState string `json:"connState,omitempty"`
+
+	// Host-only moderation hints, only in the host's room_state
+	Transport string `json:"transport,omitempty"`
+	Network   string `json:"network,omitempty"`
+}
+
+// Departure describes why a participant left, carried in room_state
+type Departure struct {
+	CID    string `json:"cid"`
+	Reason string `json:"reason"`
+}
+
+// JoinRequest is the payload of join (section 4.1).
+type JoinRequest struct {
+	Role        string `json:"role,omitempty"`
+	Token       string `json:"token,omitempty"` // JWT, when the server requires one
+	DisplayName string `json:"displayName,omitempty"`
+	HostToken   string `json:"hostToken,omitempty"`
+	ResumeToken string `json:"resumeToken,omitempty"`
+}
+
+// Joined is the payload of joined (section 4.2).
+type Joined struct {
+	HostCID              string        `json:"hostCid"`
+	InitiatorCID         string        `json:"initiatorCid"`
+	Participants         []Participant `json:"participants"`
+	Observers            []Participant `json:"observers"`
+	Capacity             int           `json:"capacity"`
+	Count                int           `json:"count"`
+	Label                string        `json:"label,omitempty"`
+	TurnToken            string        `json:"turnToken,omitempty"`
+	TurnTokenExpiresAt   int64         `json:"turnTokenExpiresAt,omitempty"`
+	ResumeToken          string        `json:"resumeToken,omitempty"`
+	ResumeTokenExpiresAt int64         `json:"resumeTokenExpiresAt,omitempty"`
+}
+
+// RoomState is the payload of room_state (section 4.3).
+type RoomState struct {
+	HostCID      string        `json:"hostCid"`
+	InitiatorCID string        `json:"initiatorCid"`
+	Participants []Participant `json:"participants"`
+	Observers    []Participant `json:"observers"`
+	Capacity     int           `json:"capacity"`
+	Count        int           `json:"count"`
+	Label        string        `json:"label,omitempty"`
+	Departed     *Departure    `json:"departed,omitempty"`
+}
+
+// SDP is the payload of offer and answer. The server fills in From on
+// relay, and Seq and JoinedAt on offers for glare resolution.
+type SDP struct {
+	SDP      string `json:"sdp"`
+	From     string `json:"from,omitempty"`
+	Seq      int64  `json:"seq,omitempty"`
+	JoinedAt int64  `json:"joinedAt,omitempty"`
+}
+
+// ICECandidate mirrors the browser's RTCIceCandidateInit.
+type ICECandidate struct {
+	Candidate        string `json:"candidate"`
+	SDPMid           string `json:"sdpMid,omitempty"`
+	SDPMLineIndex    *int   `json:"sdpMLineIndex,omitempty"`
+	UsernameFragment string `json:"usernameFragment,omitempty"`
+}
+
+// ICE is the payload of ice. The server fills in From on relay.
+type ICE struct {
+	Candidate ICECandidate `json:"candidate"`
+	From      string       `json:"from,omitempty"`
+}
+
+// Error codes (Error.Code), see section 4.10
+const (
+	CodeBadRequest          = "BAD_REQUEST"
+	CodeUnsupportedVersion  = "UNSUPPORTED_VERSION"
+	CodeMessageTooLarge     = "MESSAGE_TOO_LARGE"
+	CodeInvalidRoomID       = "INVALID_ROOM_ID"
+	CodeUnauthorized        = "UNAUTHORIZED"
+	CodeNotHost             = "NOT_HOST"
+	CodeObserverReadonly    = "OBSERVER_READONLY"
+	CodeCannotRelayToSelf   = "CANNOT_RELAY_TO_SELF"
+	CodeRoomFull            = "ROOM_FULL"
+	CodeRoomQuotaExceeded   = "ROOM_QUOTA_EXCEEDED"
+	CodeTooManyRoomSwitches = "TOO_MANY_ROOM_SWITCHES"
+	CodeRelayRateLimited    = "RELAY_RATE_LIMITED"
+	CodeServerNotConfigured = "SERVER_NOT_CONFIGURED"
+	CodeNameTaken           = "NAME_TAKEN"
+	CodeBadNegotiationState = "BAD_NEGOTIATION_STATE"
+	CodeRoomClosed          = "ROOM_CLOSED"
+	CodeQuotaExceeded       = "QUOTA_EXCEEDED"
+)
+
+// Error is the payload of error (section 4.10). It satisfies error, so a
+// rejected request can be returned as one.
+type Error struct {
+	Code      string          `json:"code"`
+	Message   string          `json:"message"`
+	Category  string          `json:"category"`
+	Retryable bool            `json:"retryable"`
+	Details   json.RawMessage `json:"details,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return e.Code + ": " + e.Message
+}
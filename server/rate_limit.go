@@ -1,10 +1,14 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"log"
+	"math"
 	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -49,6 +53,19 @@ func (tb *SimpleTokenBucket) Allow() bool {
 	return false
 }
 
+// RetryAfter returns how long until the next token is available, or 0 if
+// one is available now.
+func (tb *SimpleTokenBucket) RetryAfter() time.Duration {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tokens := tb.tokens + time.Since(tb.lastRefillTime).Seconds()*tb.refillRate
+	if tokens >= 1.0 {
+		return 0
+	}
+	return time.Duration((1.0 - tokens) / tb.refillRate * float64(time.Second))
+}
+
 // Global Rate Limiter Manager
 type IPLimiter struct {
 	ips   map[string]*SimpleTokenBucket
@@ -66,6 +83,7 @@ func NewIPLimiter(r float64, b float64) *IPLimiter {
 }
 
 func (i *IPLimiter) GetLimiter(ip string) *SimpleTokenBucket {
+	ip = rateLimitKey(ip)
 	i.mu.Lock()
 	defer i.mu.Unlock()
 
@@ -80,12 +98,52 @@ func (i *IPLimiter) GetLimiter(ip string) *SimpleTokenBucket {
 
 // Cleanup routine to remove old IPs could be added here to prevent memory leaks
 
+// IPConnCounter caps the number of simultaneously open connections per IP.
+type IPConnCounter struct {
+	counts map[string]int
+	mu     sync.Mutex
+	max    int // 0 disables the cap
+}
+
+func NewIPConnCounter(max int) *IPConnCounter {
+	return &IPConnCounter{
+		counts: make(map[string]int),
+		max:    max,
+	}
+}
+
+// Acquire reserves a connection slot for ip, returning false if the cap is reached.
+func (i *IPConnCounter) Acquire(ip string) bool {
+	ip = rateLimitKey(ip)
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.max > 0 && i.counts[ip] >= i.max {
+		return false
+	}
+	i.counts[ip]++
+	return true
+}
+
+// Release frees a slot previously reserved with Acquire.
+func (i *IPConnCounter) Release(ip string) {
+	ip = rateLimitKey(ip)
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.counts[ip] <= 1 {
+		delete(i.counts, ip)
+		return
+	}
+	i.counts[ip]--
+}
+
 // Middleware
 func rateLimitMiddleware(limiter *IPLimiter, next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ip := getClientIP(r)
-		if !limiter.GetLimiter(ip).Allow() {
-			http.Error(w, "429 Too Many Requests", http.StatusTooManyRequests)
+		if bucket := limiter.GetLimiter(ip); !bucket.Allow() {
+			writeRateLimited(w, bucket.RetryAfter())
 			log.Printf("Rate limit exceeded for IP: %s", ip)
 			return
 		}
@@ -93,26 +151,240 @@ func rateLimitMiddleware(limiter *IPLimiter, next http.HandlerFunc) http.Handler
 	}
 }
 
-func getClientIP(r *http.Request) string {
-	trustProxy := strings.EqualFold(os.Getenv("TRUST_PROXY"), "1")
-	if trustProxy {
-		realIP := strings.TrimSpace(r.Header.Get("X-Real-IP"))
-		if realIP != "" {
-			return realIP
+// writeRateLimited writes a 429 with a JSON body the frontend can parse,
+// {"error": "rate_limited", "retryAfter": <seconds>}, plus a matching
+// Retry-After header. Also used before WebSocket upgrades, where the body
+// is just a plain HTTP response.
+func writeRateLimited(w http.ResponseWriter, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":      "rate_limited",
+		"retryAfter": seconds,
+	})
+}
+
+// IPRoomQuota limits how many distinct rooms one IP may create per window.
+type IPRoomQuota struct {
+	created map[string]map[string]time.Time // ip -> rid -> created at
+	mu      sync.Mutex
+	max     int // 0 disables the quota
+	window  time.Duration
+}
+
+func NewIPRoomQuota(max int, window time.Duration) *IPRoomQuota {
+	return &IPRoomQuota{
+		created: make(map[string]map[string]time.Time),
+		max:     max,
+		window:  window,
+	}
+}
+
+// Allow records that ip is creating rid, returning false if the IP has
+// already created max other rooms within the window.
+func (q *IPRoomQuota) Allow(ip, rid string) bool {
+	if q.max <= 0 {
+		return true
+	}
+
+	ip = rateLimitKey(ip)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	rooms := q.created[ip]
+	for id, at := range rooms {
+		if now.Sub(at) > q.window {
+			delete(rooms, id)
+		}
+	}
+
+	if _, seen := rooms[rid]; !seen && len(rooms) >= q.max {
+		return false
+	}
+	if rooms == nil {
+		rooms = make(map[string]time.Time)
+		q.created[ip] = rooms
+	}
+	rooms[rid] = now
+	return true
+}
+
+// Cleanup drops IPs whose rooms have all aged out of the window.
+func (q *IPRoomQuota) Cleanup() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	for ip, rooms := range q.created {
+		for id, at := range rooms {
+			if now.Sub(at) > q.window {
+				delete(rooms, id)
+			}
 		}
-		// Check X-Forwarded-For first (since we are behind Nginx)
-		forwarded := r.Header.Get("X-Forwarded-For")
-		if forwarded != "" {
-			// X-Forwarded-For can be a comma-separated list
-			ips := strings.Split(forwarded, ",")
-			return strings.TrimSpace(ips[0])
+		if len(rooms) == 0 {
+			delete(q.created, ip)
 		}
 	}
+}
+
+var (
+	ipv6PrefixOnce sync.Once
+	ipv6Prefix     int
+)
+
+// loadIPv6Prefix returns the prefix length IPv6 clients are grouped by
+// (IPV6_RATE_LIMIT_PREFIX, default 64).
+func loadIPv6Prefix() int {
+	ipv6PrefixOnce.Do(func() {
+		ipv6Prefix = envInt("IPV6_RATE_LIMIT_PREFIX", 64)
+		if ipv6Prefix < 1 || ipv6Prefix > 128 {
+			log.Printf("[CONFIG] IPV6_RATE_LIMIT_PREFIX must be 1-128. Using 64")
+			ipv6Prefix = 64
+		}
+	})
+	return ipv6Prefix
+}
 
-	// Fallback to RemoteAddr
-	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+// rateLimitKey maps a client IP to the key per-IP limits are counted under.
+// A single IPv6 subscriber usually holds a whole /64, so IPv6 addresses are
+// truncated to their prefix; otherwise rotating addresses would evade limits.
+// IPv4 addresses (and anything unparseable) are used as-is.
+func rateLimitKey(ip string) string {
+	return prefixKey(ip, loadIPv6Prefix())
+}
+
+// prefixKey is rateLimitKey with the IPv6 prefix length given.
+func prefixKey(ip string, ipv6Prefix int) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil || parsed.To4() != nil {
+		return ip
+	}
+	network := parsed.Mask(net.CIDRMask(ipv6Prefix, 128))
+	return network.String() + "/" + strconv.Itoa(ipv6Prefix)
+}
+
+// coarseNetwork returns a privacy-preserving hint of where ip is: the first
+// two octets of an IPv4 address (203.0.x.x) or the /32 of an IPv6 address.
+func coarseNetwork(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return fmt.Sprintf("%d.%d.x.x", v4[0], v4[1])
+	}
+	return parsed.Mask(net.CIDRMask(32, 128)).String() + "/32"
+}
+
+// Networks treated as trusted proxies when TRUST_PROXY=1 and no explicit
+// TRUSTED_PROXIES list is configured (nginx runs on the docker bridge or host).
+var defaultTrustedProxies = []string{
+	"127.0.0.0/8",
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"::1/128",
+	"fc00::/7",
+}
+
+var (
+	trustedProxiesOnce sync.Once
+	trustedProxies     []*net.IPNet
+)
+
+// parseTrustedProxies parses a comma-separated list of CIDRs or bare IPs.
+func parseTrustedProxies(raw string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			log.Printf("[CONFIG] Ignoring invalid TRUSTED_PROXIES entry %q: %v", entry, err)
+			continue
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets
+}
+
+func loadTrustedProxies() []*net.IPNet {
+	trustedProxiesOnce.Do(func() {
+		if raw := strings.TrimSpace(os.Getenv("TRUSTED_PROXIES")); raw != "" {
+			trustedProxies = parseTrustedProxies(raw)
+		} else if envBool("TRUST_PROXY", false) {
+			trustedProxies = parseTrustedProxies(strings.Join(defaultTrustedProxies, ","))
+		}
+	})
+	return trustedProxies
+}
+
+func isTrustedProxy(ip string, trusted []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, ipNet := range trusted {
+		if ipNet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// getClientIP returns the address of the connecting client. Forwarding
+// headers are only honored when the direct peer is a trusted proxy;
+// otherwise a client could spoof them to evade rate limits.
+func getClientIP(r *http.Request) string {
+	return clientIPBehind(r, loadTrustedProxies())
+}
+
+// clientIPBehind is getClientIP with the trusted proxy networks given.
+func clientIPBehind(r *http.Request, trusted []*net.IPNet) string {
+	remoteIP, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		return r.RemoteAddr
+		remoteIP = r.RemoteAddr
 	}
-	return ip
+
+	if !isTrustedProxy(remoteIP, trusted) {
+		return remoteIP
+	}
+
+	// Walk X-Forwarded-For from the nearest hop outwards and take the first
+	// address that isn't one of our proxies. Anything further left was
+	// supplied by the client and can't be trusted.
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		hops := strings.Split(forwarded, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if hop == "" {
+				continue
+			}
+			if !isTrustedProxy(hop, trusted) {
+				return hop
+			}
+		}
+	}
+
+	// Our proxy overwrites X-Real-IP with its peer address
+	if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); realIP != "" {
+		return realIP
+	}
+
+	return remoteIP
 }
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIPBehind(t *testing.T) {
+	trusted := parseTrustedProxies("10.0.0.0/8, 2001:db8:ffff::1")
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  string
+		realIP     string
+		want       string
+	}{
+		{"direct client", "203.0.113.7:5000", "", "", "203.0.113.7"},
+		{"untrusted peer spoofing X-Forwarded-For", "203.0.113.7:5000", "198.51.100.1", "", "203.0.113.7"},
+		{"untrusted peer spoofing X-Real-IP", "203.0.113.7:5000", "", "198.51.100.1", "203.0.113.7"},
+		{"untrusted peer claiming to be a proxy", "203.0.113.7:5000", "10.0.0.5", "", "203.0.113.7"},
+		{"trusted proxy", "10.0.0.2:5000", "198.51.100.1", "", "198.51.100.1"},
+		{"client-prepended hop is ignored", "10.0.0.2:5000", "192.0.2.66, 198.51.100.1", "", "198.51.100.1"},
+		{"chain of trusted proxies", "10.0.0.2:5000", "198.51.100.1, 10.0.0.9, 10.1.2.3", "", "198.51.100.1"},
+		{"trusted proxy without forwarding headers", "10.0.0.2:5000", "", "", "10.0.0.2"},
+		{"X-Real-IP from trusted proxy", "10.0.0.2:5000", "", "198.51.100.1", "198.51.100.1"},
+		{"only trusted hops falls back to X-Real-IP", "10.0.0.2:5000", "10.0.0.9", "198.51.100.1", "198.51.100.1"},
+		{"empty hops are skipped", "10.0.0.2:5000", "198.51.100.1, ,", "", "198.51.100.1"},
+		{"IPv6 trusted proxy", "[2001:db8:ffff::1]:443", "2001:db8:1::7", "", "2001:db8:1::7"},
+		{"IPv6 untrusted peer spoofing", "[2001:db8:2::1]:443", "2001:db8:1::7", "", "2001:db8:2::1"},
+		{"RemoteAddr without port", "203.0.113.7", "198.51.100.1", "", "203.0.113.7"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			if tt.realIP != "" {
+				r.Header.Set("X-Real-IP", tt.realIP)
+			}
+			if got := clientIPBehind(r, trusted); got != tt.want {
+				t.Errorf("clientIPBehind() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// Without TRUSTED_PROXIES nothing is trusted, so headers never count.
+func TestClientIPBehindNoTrustedProxies(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "127.0.0.1:5000"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1")
+	r.Header.Set("X-Real-IP", "198.51.100.2")
+	if got := clientIPBehind(r, nil); got != "127.0.0.1" {
+		t.Errorf("clientIPBehind() = %q, want 127.0.0.1", got)
+	}
+}
+
+func TestPrefixKey(t *testing.T) {
+	tests := []struct {
+		ip     string
+		prefix int
+		want   string
+	}{
+		{"203.0.113.7", 64, "203.0.113.7"},
+		{"203.0.113.7", 48, "203.0.113.7"},
+		{"::ffff:203.0.113.7", 64, "::ffff:203.0.113.7"},
+		{"2001:db8:1:2:aaaa:bbbb:cccc:dddd", 64, "2001:db8:1:2::/64"},
+		{"2001:db8:1:2::1", 64, "2001:db8:1:2::/64"},
+		{"2001:db8:1:3::1", 64, "2001:db8:1:3::/64"},
+		{"2001:db8:1:2::1", 48, "2001:db8:1::/48"},
+		{"2001:db8:1:2::1", 128, "2001:db8:1:2::1/128"},
+		{"::1", 64, "::/64"},
+		{"not-an-ip", 64, "not-an-ip"},
+		{"", 64, ""},
+	}
+	for _, tt := range tests {
+		if got := prefixKey(tt.ip, tt.prefix); got != tt.want {
+			t.Errorf("prefixKey(%q, %d) = %q, want %q", tt.ip, tt.prefix, got, tt.want)
+		}
+	}
+}
+
+// Clients are keyed by their /64 whether the address comes from the
+// connection or from a trusted proxy's X-Forwarded-For.
+func TestRateLimitKeyFromRequest(t *testing.T) {
+	trusted := parseTrustedProxies("10.0.0.0/8")
+	key := func(remoteAddr, forwarded string) string {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = remoteAddr
+		if forwarded != "" {
+			r.Header.Set("X-Forwarded-For", forwarded)
+		}
+		return prefixKey(clientIPBehind(r, trusted), 64)
+	}
+
+	tests := []struct {
+		name       string
+		a, b       [2]string // RemoteAddr, X-Forwarded-For
+		sameBucket bool
+	}{
+		{"IPv4 RemoteAddr, same address", [2]string{"203.0.113.7:1000", ""}, [2]string{"203.0.113.7:2000", ""}, true},
+		{"IPv4 RemoteAddr, neighbours", [2]string{"203.0.113.7:1000", ""}, [2]string{"203.0.113.8:1000", ""}, false},
+		{"IPv6 RemoteAddr, same /64", [2]string{"[2001:db8:1:2::1]:1000", ""}, [2]string{"[2001:db8:1:2:ffff::9]:1000", ""}, true},
+		{"IPv6 RemoteAddr, other /64", [2]string{"[2001:db8:1:2::1]:1000", ""}, [2]string{"[2001:db8:1:3::1]:1000", ""}, false},
+		{"IPv6 X-Forwarded-For, same /64", [2]string{"10.0.0.2:1000", "2001:db8:1:2::1"}, [2]string{"10.0.0.3:1000", "2001:db8:1:2::abcd"}, true},
+		{"IPv6 X-Forwarded-For, other /64", [2]string{"10.0.0.2:1000", "2001:db8:1:2::1"}, [2]string{"10.0.0.2:1000", "2001:db8:1:3::1"}, false},
+		{"IPv6 X-Forwarded-For matches direct", [2]string{"10.0.0.2:1000", "2001:db8:1:2::1"}, [2]string{"[2001:db8:1:2::2]:1000", ""}, true},
+		{"IPv4 X-Forwarded-For, neighbours", [2]string{"10.0.0.2:1000", "198.51.100.1"}, [2]string{"10.0.0.2:1000", "198.51.100.2"}, false},
+		{"spoofed X-Forwarded-For from untrusted IPv6 peer", [2]string{"[2001:db8:1:2::1]:1000", "2001:db8:9::1"}, [2]string{"[2001:db8:1:2::2]:1000", "2001:db8:8::1"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ka, kb := key(tt.a[0], tt.a[1]), key(tt.b[0], tt.b[1])
+			if (ka == kb) != tt.sameBucket {
+				t.Errorf("keys %q and %q: same bucket = %v, want %v", ka, kb, ka == kb, tt.sameBucket)
+			}
+		})
+	}
+}
+
+// With the default IPV6_RATE_LIMIT_PREFIX, addresses in one /64 share a bucket.
+func TestIPLimiterSharesBucketPerPrefix(t *testing.T) {
+	limiter := NewIPLimiter(1, 1)
+	if limiter.GetLimiter("2001:db8:1:2::1") != limiter.GetLimiter("2001:db8:1:2:ffff:ffff:ffff:ffff") {
+		t.Error("addresses in one /64 got separate buckets")
+	}
+	if limiter.GetLimiter("2001:db8:1:2::1") == limiter.GetLimiter("2001:db8:1:3::1") {
+		t.Error("addresses in different /64s share a bucket")
+	}
+	if limiter.GetLimiter("203.0.113.7") == limiter.GetLimiter("203.0.113.8") {
+		t.Error("IPv4 neighbours share a bucket")
+	}
+}
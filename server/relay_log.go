@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Relay debug logging. With LOG_RELAYS=1 every relayed offer/answer/ice is
+// logged with its payload. SDP and ICE candidates carry client IP
+// addresses, so unless LOG_REDACT_SDP=0 their values are replaced with a
+// size marker before logging; either way the logged payload is truncated.
+const relayLogMaxPayload = 512
+
+type relayLogConfig struct {
+	enabled bool
+	redact  bool
+}
+
+func loadRelayLogConfig() relayLogConfig {
+	return relayLogConfig{
+		enabled: envBool("LOG_RELAYS", false),
+		redact:  envBool("LOG_REDACT_SDP", true),
+	}
+}
+
+// relayLogPayload renders payload for a relay debug log line.
+func (cfg relayLogConfig) relayLogPayload(payload json.RawMessage) string {
+	out := string(payload)
+	if cfg.redact {
+		var v interface{}
+		if err := json.Unmarshal(payload, &v); err != nil {
+			return fmt.Sprintf("[unparseable, %d bytes]", len(payload))
+		}
+		redacted, _ := json.Marshal(redactSDP(v))
+		out = string(redacted)
+	}
+	if len(out) > relayLogMaxPayload {
+		out = out[:relayLogMaxPayload] + "...(truncated)"
+	}
+	return out
+}
+
+// redactSDP replaces string values under "sdp" and "candidate" keys, at any
+// depth, with their length. Browsers nest the candidate line as
+// {"candidate": {"candidate": "...", "sdpMid": "0"}}.
+func redactSDP(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, val := range t {
+			if s, ok := val.(string); ok && (k == "sdp" || k == "candidate") {
+				t[k] = fmt.Sprintf("[redacted, %d bytes]", len(s))
+				continue
+			}
+			t[k] = redactSDP(val)
+		}
+	case []interface{}:
+		for i, val := range t {
+			t[i] = redactSDP(val)
+		}
+	}
+	return v
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+// Every HTTP request (including WebSocket upgrades and poll sessions) gets a
+// correlation ID, taken from an incoming X-Request-ID when it looks sane or
+// generated otherwise. It is echoed in the response and stored on the Client
+// so server logs can be matched with a user's report.
+const (
+	requestIDHeader    = "X-Request-ID"
+	maxRequestIDLength = 64
+)
+
+type requestIDKey struct{}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, ch := range id {
+		switch {
+		case ch >= 'a' && ch <= 'z', ch >= 'A' && ch <= 'Z', ch >= '0' && ch <= '9':
+		case ch == '-' || ch == '_' || ch == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// withRequestID assigns the request's correlation ID.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = generateID("R-")
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// requestID returns the correlation ID assigned by withRequestID.
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
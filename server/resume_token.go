@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// A resume token lets a client take its seat back after its connection
+// drops. It is handed out in joined and refreshed while the client stays
+// connected, and a join presenting it gets the signed cid back. Without a
+// valid token a rejoin is a fresh join, so guessing a cid gains nothing.
+//
+// Tokens are signed with ROOM_ID_SECRET, so they survive a restart along
+// with STATE_FILE seats.
+
+// How often connected members get a fresh resume token
+const resumeTokenRefresh = time.Minute
+
+type resumeTokenClaims struct {
+	SID string `json:"sid"` // session the token was issued to
+	CID string `json:"cid"`
+	RID string `json:"rid"`
+	Exp int64  `json:"exp"`
+}
+
+// resumeTokenTTL covers the longest a seat can be held after its
+// connection stops answering: until the stale connection is reaped, or the
+// empty room's grace runs out. Tokens are refreshed well within that, so a
+// client's latest token outlives its seat.
+func (h *Hub) resumeTokenTTL() time.Duration {
+	return resumeTokenRefresh + max(wsPongWait+wsReapMargin, pollStaleTimeout, h.emptyRoomGrace)
+}
+
+func resumeTokenMAC(secret, payload string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("resume-token|" + payload))
+	return mac.Sum(nil)
+}
+
+func issueResumeToken(sid, cid, rid string, ttl time.Duration) (string, time.Time, error) {
+	secret, err := roomIDSecret()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	expiresAt := time.Now().Add(ttl)
+	payloadBytes, err := json.Marshal(resumeTokenClaims{SID: sid, CID: cid, RID: rid, Exp: expiresAt.Unix()})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(payloadBytes)
+	sig := base64.RawURLEncoding.EncodeToString(resumeTokenMAC(secret, payload))
+
+	return payload + "." + sig, expiresAt, nil
+}
+
+// verifyResumeToken returns the cid token may resume in room rid.
+func verifyResumeToken(token, rid string) (string, bool) {
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", false
+	}
+	secret, err := roomIDSecret()
+	if err != nil {
+		return "", false
+	}
+	sigBytes, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(sigBytes, resumeTokenMAC(secret, payload)) {
+		return "", false
+	}
+
+	payloadBytes, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return "", false
+	}
+	var claims resumeTokenClaims
+	if err := json.Unmarshal(payloadBytes, &claims); err != nil {
+		return "", false
+	}
+	if claims.RID != rid || claims.CID == "" || time.Now().Unix() > claims.Exp {
+		return "", false
+	}
+	return claims.CID, true
+}
+
+// refreshResumeTokens sends every room member a new resume token for each
+// room it is in, before the one it holds expires.
+func (h *Hub) refreshResumeTokens() {
+	ttl := h.resumeTokenTTL()
+	type member struct {
+		client *Client
+		cid    string
+	}
+	for _, room := range h.rooms.snapshot() {
+		var members []member
+		func() {
+			room.mu.Lock()
+			defer room.mu.Unlock()
+			for client, cid := range room.Participants {
+				members = append(members, member{client, cid})
+			}
+			for client, cid := range room.Observers {
+				members = append(members, member{client, cid})
+			}
+		}()
+
+		for _, m := range members {
+			token, expiresAt, err := issueResumeToken(m.client.sid, m.cid, room.RID, ttl)
+			if err != nil {
+				return
+			}
+			payload, _ := json.Marshal(map[string]interface{}{
+				"resumeToken":          token,
+				"resumeTokenExpiresAt": expiresAt.Unix(),
+			})
+			m.client.sendMessage(Message{
+				V:       1,
+				Type:    "resume_token",
+				RID:     room.RID,
+				Payload: payload,
+			})
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Room lifecycle events delivered to RoomObservers
+const (
+	roomEventJoin      = "join"
+	roomEventLeave     = "leave"
+	roomEventRoomEnded = "room_ended"
+	// Relays use the relayed message type (offer, answer, ice)
+)
+
+// RoomEvent is signaling metadata copied to observers. It never carries
+// SDP or ICE payloads.
+type RoomEvent struct {
+	Type   string `json:"type"`
+	RID    string `json:"rid"`
+	CID    string `json:"cid,omitempty"`
+	To     string `json:"to,omitempty"`
+	Role   string `json:"role,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	Ts     int64  `json:"ts"`
+
+	// Position in the hub's event sequence; sent as the SSE id, not in data
+	ID int64 `json:"-"`
+}
+
+// RoomObserver receives room events. OnRoomEvent may be called with room
+// locks held, so implementations must not block.
+type RoomObserver interface {
+	OnRoomEvent(ev RoomEvent)
+}
+
+// roomObserverSet fans events out to observers. With a history size set,
+// it also numbers every event and keeps the most recent ones, even while
+// nobody is subscribed, so a stream that reconnects can pick up where it
+// left off.
+type roomObserverSet struct {
+	mu        sync.Mutex
+	observers map[RoomObserver]struct{}
+	// len(observers), readable without mu so that emit, called on every
+	// relay in every room, skips the lock while there's nothing to do
+	observerCount atomic.Int64
+
+	historySize int         // fixed at construction, so read without mu
+	history     []RoomEvent // oldest first
+	lastID      int64
+}
+
+func newRoomObserverSet(historySize int) *roomObserverSet {
+	return &roomObserverSet{observers: make(map[RoomObserver]struct{}), historySize: historySize}
+}
+
+func (s *roomObserverSet) add(o RoomObserver) {
+	s.mu.Lock()
+	s.observers[o] = struct{}{}
+	s.observerCount.Store(int64(len(s.observers)))
+	s.mu.Unlock()
+}
+
+// addAfter adds o and returns the retained events after afterID, in order.
+// Both happen under one lock, so every event reaches o exactly once: from
+// the returned backlog if it came before, through OnRoomEvent if after.
+// complete is false when events after afterID have already been dropped
+// from the history.
+func (s *roomObserverSet) addAfter(o RoomObserver, afterID int64) (backlog []RoomEvent, complete bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.observers[o] = struct{}{}
+	s.observerCount.Store(int64(len(s.observers)))
+	complete = afterID >= s.lastID || (len(s.history) > 0 && s.history[0].ID <= afterID+1)
+	for _, ev := range s.history {
+		if ev.ID > afterID {
+			backlog = append(backlog, ev)
+		}
+	}
+	return backlog, complete
+}
+
+func (s *roomObserverSet) remove(o RoomObserver) {
+	s.mu.Lock()
+	delete(s.observers, o)
+	s.observerCount.Store(int64(len(s.observers)))
+	s.mu.Unlock()
+}
+
+func (s *roomObserverSet) emit(ev RoomEvent) {
+	if s.historySize == 0 && s.observerCount.Load() == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ev.Ts = time.Now().UnixMilli()
+	if s.historySize > 0 {
+		s.lastID++
+		ev.ID = s.lastID
+		s.history = append(s.history, ev)
+		if len(s.history) > s.historySize {
+			s.history = s.history[1:]
+		}
+	}
+	for o := range s.observers {
+		o.OnRoomEvent(ev)
+	}
+}
+
+// streamObserver buffers events for one /internal/subscribe stream.
+// An event that doesn't fit in the buffer is dropped rather than stalling
+// the hub, and the stream is ended: the client reconnects with
+// Last-Event-ID and gets the rest from the history.
+type streamObserver struct {
+	rid      string // only events for this room, empty for all
+	events   chan RoomEvent
+	overflow chan struct{} // closed once an event was dropped
+}
+
+// OnRoomEvent is called with the observer set's lock held, so it never
+// runs concurrently with itself.
+func (o *streamObserver) OnRoomEvent(ev RoomEvent) {
+	if o.rid != "" && o.rid != ev.RID {
+		return
+	}
+	select {
+	case <-o.overflow:
+		return
+	default:
+	}
+	select {
+	case o.events <- ev:
+	default:
+		close(o.overflow)
+	}
+}
+
+const subscribeKeepalive = 15 * time.Second
+
+// Events kept for Last-Event-ID replay when the event stream is enabled
+const roomEventHistorySize = 4096
+
+// eventHistorySize is the history to keep: none unless the event stream
+// is enabled, since every relay would otherwise pay for it for nothing.
+func eventHistorySize() int {
+	if strings.TrimSpace(os.Getenv("INTERNAL_SUBSCRIBE_SECRET")) == "" {
+		return 0
+	}
+	return roomEventHistorySize
+}
+
+// Event ids are "<epoch>-<n>". The epoch is fixed per process, so an id
+// from before a restart is recognized as such instead of being compared
+// against a counter that started over.
+var roomEventEpoch = strconv.FormatInt(time.Now().UnixNano(), 36)
+
+func formatEventID(id int64) string {
+	return roomEventEpoch + "-" + strconv.FormatInt(id, 10)
+}
+
+// parseEventID returns the sequence number in a Last-Event-ID from this
+// process, or false for one from an earlier process (or garbage).
+func parseEventID(raw string) (int64, bool) {
+	epoch, n, ok := strings.Cut(raw, "-")
+	if !ok || epoch != roomEventEpoch {
+		return 0, false
+	}
+	id, err := strconv.ParseInt(n, 10, 64)
+	return id, err == nil && id >= 0
+}
+
+// handleInternalSubscribe streams room events as Server-Sent Events to
+// services holding INTERNAL_SUBSCRIBE_SECRET. Disabled when the secret is unset.
+//
+//	GET /internal/subscribe[?rid=...]
+//	Authorization: Bearer <secret>
+//
+// A reconnect sending Last-Event-ID first gets the events it missed, as far
+// back as the history goes. With SSE_MAX_DURATION set, streams are ended
+// cleanly after that long, ahead of proxies that would cut them abruptly;
+// the client reconnects after the retry delay and resumes from its last id.
+func handleInternalSubscribe(hub *Hub) http.HandlerFunc {
+	// Reconnect delay advertised to EventSource clients
+	retry := time.Duration(max(1, envInt("SSE_RETRY_MS", 3000))) * time.Millisecond
+	// Longest a single stream stays open (0 = no limit)
+	maxDuration := envDuration("SSE_MAX_DURATION", 0)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		secret := strings.TrimSpace(os.Getenv("INTERNAL_SUBSCRIBE_SECRET"))
+		if secret == "" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+		// The stream outlives the server's WriteTimeout
+		http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+		obs := &streamObserver{
+			rid:      r.URL.Query().Get("rid"),
+			events:   make(chan RoomEvent, 256),
+			overflow: make(chan struct{}),
+		}
+		var backlog []RoomEvent
+		if lastID, ok := parseEventID(r.Header.Get("Last-Event-ID")); ok {
+			var complete bool
+			backlog, complete = hub.events.addAfter(obs, lastID)
+			if !complete {
+				log.Printf("[SUBSCRIBE] Observer from %s resumed after %d but older events were already dropped", getClientIP(r), lastID)
+			}
+			if obs.rid != "" {
+				backlog = slices.DeleteFunc(backlog, func(ev RoomEvent) bool { return ev.RID != obs.rid })
+			}
+		} else {
+			hub.events.add(obs)
+		}
+		defer hub.events.remove(obs)
+
+		log.Printf("[SUBSCRIBE] Observer connected from %s (rid filter: %q, %d replayed)", getClientIP(r), obs.rid, len(backlog))
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "retry: %d\n\n", retry.Milliseconds())
+
+		writeEvent := func(ev RoomEvent) error {
+			data, _ := json.Marshal(ev)
+			if ev.ID != 0 {
+				_, err := fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", formatEventID(ev.ID), ev.Type, data)
+				return err
+			}
+			_, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+			return err
+		}
+		for _, ev := range backlog {
+			if err := writeEvent(ev); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+
+		keepalive := time.NewTicker(subscribeKeepalive)
+		defer keepalive.Stop()
+
+		// A nil channel never fires, so without a limit the stream is open-ended
+		var expired <-chan time.Time
+		if maxDuration > 0 {
+			timer := time.NewTimer(maxDuration)
+			defer timer.Stop()
+			expired = timer.C
+		}
+
+		for {
+			select {
+			case ev := <-obs.events:
+				if err := writeEvent(ev); err != nil {
+					return
+				}
+				flusher.Flush()
+			case <-expired:
+				// Events still queued here have ids past the last one sent,
+				// so the reconnect gets them from the history
+				fmt.Fprintf(w, "retry: %d\n\n", retry.Milliseconds())
+				flusher.Flush()
+				log.Printf("[SUBSCRIBE] Ending stream from %s after %s", getClientIP(r), maxDuration)
+				return
+			case <-obs.overflow:
+				// Like expiry, except the events past the last one sent
+				// include one that was dropped
+				fmt.Fprintf(w, "retry: %d\n\n", retry.Milliseconds())
+				flusher.Flush()
+				log.Printf("[SUBSCRIBE] Ending stream from %s: it fell behind and dropped an event", getClientIP(r))
+				return
+			case <-keepalive.C:
+				if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+					return
+				}
+				flusher.Flush()
+			case <-r.Context().Done():
+				log.Printf("[SUBSCRIBE] Observer from %s disconnected", getClientIP(r))
+				return
+			}
+		}
+	}
+}
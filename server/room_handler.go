@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// handleRoomInfo serves GET /api/rooms/{rid} with occupancy and activity
+// for a single room. Only counts are exposed, never participant IDs.
+func handleRoomInfo(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		rid := r.PathValue("rid")
+		if err := validateRoomID(rid); err != nil {
+			if errors.Is(err, ErrRoomIDSecretMissing) {
+				http.Error(w, "Room ID service unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			http.Error(w, "Invalid room ID", http.StatusBadRequest)
+			return
+		}
+
+		info := map[string]interface{}{
+			"rid":              rid,
+			"participantCount": 0,
+		}
+		if room, ok := hub.rooms.get(rid); ok {
+			func() {
+				room.mu.Lock()
+				defer room.mu.Unlock()
+				info["participantCount"] = len(room.Participants)
+				info["createdAt"] = room.CreatedAt.UnixMilli()
+				info["lastActivity"] = room.LastActivity.UnixMilli()
+			}()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(info)
+	}
+}
@@ -7,28 +7,96 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"log"
 	"os"
+	"sync"
 )
 
 const (
-	roomIDVersion      = "v1"
-	roomIDEntity       = "room"
-	roomIDRandomBytes  = 12
-	roomIDTagBytes     = 8
-	roomIDTotalBytes   = roomIDRandomBytes + roomIDTagBytes
-	roomIDEncodedBytes = 27
+	roomIDVersion  = "v1"
+	roomIDEntity   = "room"
+	roomIDTagBytes = 8
+
+	// Random bytes per room ID, overridable via ROOM_ID_RANDOM_BYTES
+	roomIDDefaultRandomBytes = 12
+	roomIDMinRandomBytes     = 12
+	roomIDMaxRandomBytes     = 32
+
+	// Room IDs may carry one signed capacity byte between the random part
+	// and the tag, fixing that room's participant cap at creation.
+	roomIDCapacityBytes = 1
+	roomIDMaxCapacity   = 255
+
+	roomHostTokenBytes = 16
+)
+
+// roomIDLayout holds the token sizes derived from the configured entropy.
+// With the default 12 random bytes, tokens are 27 characters (28 with a
+// capacity byte).
+type roomIDLayout struct {
+	randomBytes          int
+	totalBytes           int
+	encodedBytes         int
+	capacityTotalBytes   int
+	capacityEncodedBytes int
+}
+
+var (
+	roomIDLayoutOnce sync.Once
+	roomIDSizes      roomIDLayout
 )
 
+func loadRoomIDLayout() roomIDLayout {
+	roomIDLayoutOnce.Do(func() {
+		n := envInt("ROOM_ID_RANDOM_BYTES", roomIDDefaultRandomBytes)
+		if n < roomIDMinRandomBytes || n > roomIDMaxRandomBytes {
+			log.Printf("[CONFIG] ROOM_ID_RANDOM_BYTES must be %d-%d. Using %d", roomIDMinRandomBytes, roomIDMaxRandomBytes, roomIDDefaultRandomBytes)
+			n = roomIDDefaultRandomBytes
+		}
+		roomIDSizes = newRoomIDLayout(n)
+	})
+	return roomIDSizes
+}
+
+func newRoomIDLayout(randomBytes int) roomIDLayout {
+	total := randomBytes + roomIDTagBytes
+	return roomIDLayout{
+		randomBytes:          randomBytes,
+		totalBytes:           total,
+		encodedBytes:         base64.RawURLEncoding.EncodedLen(total),
+		capacityTotalBytes:   total + roomIDCapacityBytes,
+		capacityEncodedBytes: base64.RawURLEncoding.EncodedLen(total + roomIDCapacityBytes),
+	}
+}
+
 var (
 	ErrRoomIDSecretMissing = errors.New("room id secret not configured")
 )
 
-func roomIDContext() string {
+// context is mixed into a room ID's tag. IDs bound to a host token are
+// signed under their own context, so the binding adds no bytes to the ID.
+// Non-default entropy is part of the context too: otherwise a 12-byte ID
+// with a capacity byte would carry the same signed bytes as a 13-byte ID
+// without one, and validate as that under the other setting.
+func (l roomIDLayout) context(hostBound bool) string {
 	env := os.Getenv("ROOM_ID_ENV")
 	if env == "" {
 		env = "dev"
 	}
-	return fmt.Sprintf("id:%s|%s|%s", roomIDVersion, env, roomIDEntity)
+	ctx := fmt.Sprintf("id:%s|%s|%s", roomIDVersion, env, roomIDEntity)
+	if l.randomBytes != roomIDDefaultRandomBytes {
+		ctx += fmt.Sprintf("|r%d", l.randomBytes)
+	}
+	if hostBound {
+		ctx += "|host"
+	}
+	return ctx
+}
+
+// roomIDInfo is what a valid room ID carries besides its randomness.
+type roomIDInfo struct {
+	capacity  int  // embedded participant cap, 0 if none
+	hostBound bool // one seat is reserved for the holder of the host token
 }
 
 func roomIDSecret() (string, error) {
@@ -39,64 +107,125 @@ func roomIDSecret() (string, error) {
 	return secret, nil
 }
 
-func generateRoomID() (string, error) {
+// generateRoomID creates a signed room token. A non-zero capacity is
+// embedded in the token; zero produces a plain token that uses the global cap.
+// A hostBound token reserves a seat for whoever presents roomHostToken(id).
+func generateRoomID(capacity int, hostBound bool) (string, error) {
+	return loadRoomIDLayout().generate(capacity, hostBound)
+}
+
+// generate is generateRoomID under layout l.
+func (l roomIDLayout) generate(capacity int, hostBound bool) (string, error) {
+	if capacity < 0 || capacity > roomIDMaxCapacity {
+		return "", fmt.Errorf("room capacity must be between 0 and %d", roomIDMaxCapacity)
+	}
+
 	secret, err := roomIDSecret()
 	if err != nil {
 		return "", err
 	}
 
-	random := make([]byte, roomIDRandomBytes)
+	random := make([]byte, l.randomBytes)
 	if _, err := rand.Read(random); err != nil {
 		return "", err
 	}
 
+	var capacityBytes []byte
+	if capacity > 0 {
+		capacityBytes = []byte{byte(capacity)}
+	}
+
 	mac := hmac.New(sha256.New, []byte(secret))
 	mac.Write(random)
-	mac.Write([]byte(roomIDContext()))
+	mac.Write(capacityBytes)
+	mac.Write([]byte(l.context(hostBound)))
 	tag := mac.Sum(nil)[:roomIDTagBytes]
 
-	token := make([]byte, 0, roomIDTotalBytes)
+	token := make([]byte, 0, l.capacityTotalBytes)
 	token = append(token, random...)
+	token = append(token, capacityBytes...)
 	token = append(token, tag...)
 
 	return base64.RawURLEncoding.EncodeToString(token), nil
 }
 
 func validateRoomID(roomID string) error {
+	_, err := parseRoomID(roomID)
+	return err
+}
+
+// parseRoomID validates roomID and returns what it embeds.
+func parseRoomID(roomID string) (roomIDInfo, error) {
+	return loadRoomIDLayout().parse(roomID)
+}
+
+// parse is parseRoomID under layout l. IDs minted under a different layout
+// fail on length, or on the tag where two layouts share a token length.
+func (l roomIDLayout) parse(roomID string) (roomIDInfo, error) {
 	if roomID == "" {
-		return errors.New("missing room id")
+		return roomIDInfo{}, errors.New("missing room id")
 	}
-	if len(roomID) != roomIDEncodedBytes {
-		return errors.New("room id must be a 27-character token")
+	if len(roomID) != l.encodedBytes && len(roomID) != l.capacityEncodedBytes {
+		return roomIDInfo{}, fmt.Errorf("room id must be a %d- or %d-character token", l.encodedBytes, l.capacityEncodedBytes)
 	}
 
 	secret, err := roomIDSecret()
 	if err != nil {
-		return err
+		return roomIDInfo{}, err
 	}
 
 	raw, err := base64.RawURLEncoding.DecodeString(roomID)
 	if err != nil {
-		return errors.New("room id is invalid")
+		return roomIDInfo{}, errors.New("room id is invalid")
 	}
-	if len(raw) != roomIDTotalBytes {
-		return errors.New("room id is invalid")
+	if len(raw) != l.totalBytes && len(raw) != l.capacityTotalBytes {
+		return roomIDInfo{}, errors.New("room id is invalid")
 	}
 	if base64.RawURLEncoding.EncodeToString(raw) != roomID {
-		return errors.New("room id is invalid")
+		return roomIDInfo{}, errors.New("room id is invalid")
 	}
 
-	random := raw[:roomIDRandomBytes]
-	tag := raw[roomIDRandomBytes:]
+	random := raw[:l.randomBytes]
+	capacityBytes := raw[l.randomBytes : len(raw)-roomIDTagBytes]
+	tag := raw[len(raw)-roomIDTagBytes:]
 
-	mac := hmac.New(sha256.New, []byte(secret))
-	mac.Write(random)
-	mac.Write([]byte(roomIDContext()))
-	expected := mac.Sum(nil)[:roomIDTagBytes]
+	var info roomIDInfo
+	if len(capacityBytes) == roomIDCapacityBytes {
+		info.capacity = int(capacityBytes[0])
+	}
+	for _, hostBound := range []bool{false, true} {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(random)
+		mac.Write(capacityBytes)
+		mac.Write([]byte(l.context(hostBound)))
+		if hmac.Equal(tag, mac.Sum(nil)[:roomIDTagBytes]) {
+			info.hostBound = hostBound
+			return info, nil
+		}
+	}
+	return roomIDInfo{}, errors.New("room id is invalid")
+}
 
-	if !hmac.Equal(tag, expected) {
-		return errors.New("room id is invalid")
+// roomHostToken derives the host token for a host-bound room ID. It is
+// handed to the room's creator only and never appears in the link.
+func roomHostToken(roomID string) (string, error) {
+	secret, err := roomIDSecret()
+	if err != nil {
+		return "", err
 	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("host-token|" + roomID))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:roomHostTokenBytes]), nil
+}
 
-	return nil
+// validHostToken reports whether token is the host token of roomID.
+func validHostToken(roomID, token string) bool {
+	if token == "" {
+		return false
+	}
+	expected, err := roomHostToken(roomID)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal([]byte(token), []byte(expected))
 }
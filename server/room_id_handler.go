@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"strconv"
 )
 
 func handleRoomID() http.HandlerFunc {
@@ -13,17 +14,43 @@ func handleRoomID() http.HandlerFunc {
 			return
 		}
 
-		roomID, err := generateRoomID()
+		// Optional fixed capacity for this room, e.g. ?capacity=2 for a 1:1 link
+		capacity := 0
+		if raw := r.URL.Query().Get("capacity"); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n < 1 || n > roomIDMaxCapacity {
+				http.Error(w, "Invalid capacity", http.StatusBadRequest)
+				return
+			}
+			capacity = n
+		}
+
+		// ?reserveHost=1 binds the ID to a host token that always gets a seat,
+		// so invitees can't fill the room before its creator joins
+		reserveHost := r.URL.Query().Get("reserveHost") == "1"
+
+		roomID, err := generateRoomID(capacity, reserveHost)
 		if err != nil {
 			log.Printf("room id generation failed: %v", err)
 			http.Error(w, "Room ID service unavailable", http.StatusServiceUnavailable)
 			return
 		}
 
+		resp := map[string]string{
+			"roomId": roomID,
+		}
+		if reserveHost {
+			hostToken, err := roomHostToken(roomID)
+			if err != nil {
+				log.Printf("host token generation failed: %v", err)
+				http.Error(w, "Room ID service unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			resp["hostToken"] = hostToken
+		}
+
 		w.Header().Set("Content-Type", "application/json")
 		w.Header().Set("Cache-Control", "no-store")
-		json.NewEncoder(w).Encode(map[string]string{
-			"roomId": roomID,
-		})
+		json.NewEncoder(w).Encode(resp)
 	}
 }
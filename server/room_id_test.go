@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRoomIDCapacityRoundTrip(t *testing.T) {
+	for _, capacity := range []int{0, 1, 2, 8, roomIDMaxCapacity} {
+		rid, err := generateRoomID(capacity, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := 27
+		if capacity > 0 {
+			want = 28
+		}
+		if len(rid) != want {
+			t.Errorf("capacity %d: token %q has %d characters, want %d", capacity, rid, len(rid), want)
+		}
+		info, err := parseRoomID(rid)
+		if err != nil {
+			t.Fatalf("capacity %d: %v", capacity, err)
+		}
+		if info.capacity != capacity {
+			t.Errorf("capacity %d: parsed %d", capacity, info.capacity)
+		}
+	}
+
+	if _, err := generateRoomID(roomIDMaxCapacity+1, false); err == nil {
+		t.Errorf("capacity %d accepted", roomIDMaxCapacity+1)
+	}
+}
+
+// The client's call history keeps only IDs of 27 to 55 characters
+// (ROOM_ID_REGEX in client/src/utils/callHistory.ts).
+func TestRoomIDLengthsMatchClientHistory(t *testing.T) {
+	if n := newRoomIDLayout(roomIDMinRandomBytes).encodedBytes; n != 27 {
+		t.Errorf("shortest room ID is %d characters, client expects 27", n)
+	}
+	if n := newRoomIDLayout(roomIDMaxRandomBytes).capacityEncodedBytes; n != 55 {
+		t.Errorf("longest room ID is %d characters, client expects 55", n)
+	}
+}
+
+// Tokens round-trip under every entropy setting, and a token minted under
+// one setting is rejected cleanly under another, including where the two
+// share a token length (12 random bytes with capacity vs 13 without).
+func TestRoomIDLayouts(t *testing.T) {
+	sizes := []int{roomIDMinRandomBytes, 13, 16, 24, roomIDMaxRandomBytes}
+	for _, n := range sizes {
+		l := newRoomIDLayout(n)
+		for _, capacity := range []int{0, 4} {
+			for _, hostBound := range []bool{false, true} {
+				rid, err := l.generate(capacity, hostBound)
+				if err != nil {
+					t.Fatal(err)
+				}
+				want := l.encodedBytes
+				if capacity > 0 {
+					want = l.capacityEncodedBytes
+				}
+				if len(rid) != want {
+					t.Errorf("%d bytes, capacity %d: token has %d characters, want %d", n, capacity, len(rid), want)
+				}
+				info, err := l.parse(rid)
+				if err != nil {
+					t.Fatalf("%d bytes, capacity %d: %v", n, capacity, err)
+				}
+				if info.capacity != capacity || info.hostBound != hostBound {
+					t.Errorf("%d bytes: parsed %+v, want capacity %d hostBound %v", n, info, capacity, hostBound)
+				}
+
+				for _, other := range sizes {
+					if other == n {
+						continue
+					}
+					if _, err := newRoomIDLayout(other).parse(rid); err == nil {
+						t.Errorf("token minted with %d bytes (capacity %d) accepted with %d", n, capacity, other)
+					}
+				}
+			}
+		}
+
+		for _, bad := range []string{"", "x", unsignedRoomID(l.encodedBytes), unsignedRoomID(l.capacityEncodedBytes)} {
+			if _, err := l.parse(bad); err == nil {
+				t.Errorf("%d bytes: garbage %q accepted", n, bad)
+			}
+		}
+	}
+}
+
+// IDs issued before entropy became configurable still validate under the
+// default setting.
+func TestRoomIDDefaultContextUnchanged(t *testing.T) {
+	random := make([]byte, roomIDDefaultRandomBytes)
+	mac := hmac.New(sha256.New, []byte(os.Getenv("ROOM_ID_SECRET")))
+	mac.Write(random)
+	mac.Write([]byte("id:v1|dev|room"))
+	rid := base64.RawURLEncoding.EncodeToString(append(random, mac.Sum(nil)[:roomIDTagBytes]...))
+	if _, err := newRoomIDLayout(roomIDDefaultRandomBytes).parse(rid); err != nil {
+		t.Fatalf("pre-existing room ID rejected: %v", err)
+	}
+}
+
+// unsignedRoomID is an unsigned token-shaped string of n characters.
+func unsignedRoomID(n int) string {
+	return strings.Repeat("A", n)
+}
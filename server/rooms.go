@@ -0,0 +1,176 @@
+package main
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// Rooms are spread across shards keyed by a hash of the RID so that
+// join/leave/relay in different rooms don't contend on one lock.
+const roomShardCount = 32
+
+type roomShard struct {
+	mu    sync.RWMutex
+	rooms map[string]*Room
+}
+
+type roomStore struct {
+	shards [roomShardCount]*roomShard
+}
+
+func newRoomStore() *roomStore {
+	s := &roomStore{}
+	for i := range s.shards {
+		s.shards[i] = &roomShard{rooms: make(map[string]*Room)}
+	}
+	return s
+}
+
+func (s *roomStore) shard(rid string) *roomShard {
+	f := fnv.New32a()
+	f.Write([]byte(rid))
+	return s.shards[f.Sum32()%roomShardCount]
+}
+
+func (s *roomStore) get(rid string) (*Room, bool) {
+	shard := s.shard(rid)
+	shard.mu.RLock()
+	room, ok := shard.rooms[rid]
+	shard.mu.RUnlock()
+	return room, ok
+}
+
+// getOrCreate returns the room for rid, creating it if needed.
+// The second return value reports whether the room was created, the third
+// when the room became empty if it was waiting out its grace period. A
+// caller that then doesn't join should hand that to abandonJoin.
+func (s *roomStore) getOrCreate(rid string) (*Room, bool, time.Time) {
+	shard := s.shard(rid)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if room, ok := shard.rooms[rid]; ok {
+		// Touch under the shard lock so the sweep can't delete it before the
+		// caller joins, and cancel a pending empty-room deletion
+		room.mu.Lock()
+		defer room.mu.Unlock()
+		room.LastActivity = time.Now()
+		emptySince := room.emptySince
+		room.emptySince = time.Time{}
+		return room, false, emptySince
+	}
+	now := time.Now()
+	room := &Room{
+		RID:          rid,
+		Participants: make(map[*Client]string),
+		Observers:    make(map[*Client]string),
+		JoinedAt:     make(map[*Client]int64),
+		DisplayNames: make(map[*Client]string),
+		ConnStates:   make(map[*Client]string),
+		CreatedAt:    now,
+		LastActivity: now,
+	}
+	shard.rooms[rid] = room
+	return room, true, time.Time{}
+}
+
+// delete removes rid only if it still maps to room, so a stale caller
+// can't delete a room that was recreated in the meantime.
+func (s *roomStore) delete(rid string, room *Room) {
+	shard := s.shard(rid)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if shard.rooms[rid] == room {
+		delete(shard.rooms, rid)
+		room.mu.Lock()
+		defer room.mu.Unlock()
+		room.closed = true
+	}
+}
+
+func (s *roomStore) snapshot() []*Room {
+	var rooms []*Room
+	for _, shard := range s.shards {
+		shard.mu.RLock()
+		for _, room := range shard.rooms {
+			rooms = append(rooms, room)
+		}
+		shard.mu.RUnlock()
+	}
+	return rooms
+}
+
+// sweep deletes every room for which expired returns true.
+// expired is called with the room lock held.
+func (s *roomStore) sweep(expired func(room *Room) bool) []string {
+	var deleted []string
+	for _, shard := range s.shards {
+		deleted = append(deleted, shard.sweep(expired)...)
+	}
+	return deleted
+}
+
+func (shard *roomShard) sweep(expired func(room *Room) bool) []string {
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	var deleted []string
+	for rid, room := range shard.rooms {
+		if room.sweep(expired) {
+			delete(shard.rooms, rid)
+			deleted = append(deleted, rid)
+		}
+	}
+	return deleted
+}
+
+// sweep marks r closed if expired returns true for it.
+func (r *Room) sweep(expired func(room *Room) bool) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !expired(r) {
+		return false
+	}
+	r.closed = true
+	return true
+}
+
+// clientRegistry tracks live connections by session ID.
+type clientRegistry struct {
+	mu    sync.RWMutex
+	bySID map[string]*Client
+}
+
+func newClientRegistry() *clientRegistry {
+	return &clientRegistry{bySID: make(map[string]*Client)}
+}
+
+func (r *clientRegistry) add(c *Client) {
+	r.mu.Lock()
+	r.bySID[c.sid] = c
+	r.mu.Unlock()
+}
+
+func (r *clientRegistry) remove(c *Client) {
+	r.mu.Lock()
+	if r.bySID[c.sid] == c {
+		delete(r.bySID, c.sid)
+	}
+	r.mu.Unlock()
+}
+
+func (r *clientRegistry) get(sid string) (*Client, bool) {
+	r.mu.RLock()
+	c, ok := r.bySID[sid]
+	r.mu.RUnlock()
+	return c, ok
+}
+
+func (r *clientRegistry) snapshot() []*Client {
+	r.mu.RLock()
+	clients := make([]*Client, 0, len(r.bySID))
+	for _, c := range r.bySID {
+		clients = append(clients, c)
+	}
+	r.mu.RUnlock()
+	return clients
+}
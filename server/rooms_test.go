@@ -0,0 +1,165 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// BenchmarkRelay relays ICE candidates in thousands of rooms at once.
+// Relays in different rooms only share a shard's read lock, so the
+// throughput should scale with the CPU count (compare -cpu 1,4,8).
+func BenchmarkRelay(b *testing.B) {
+	const rooms = 4096
+	h := newTestHub(b)
+	h.relayRate, h.relayBurst = 1e9, 1e9
+
+	type pair struct{ from, to *Client }
+	pairs := make([]pair, rooms)
+	for i := range pairs {
+		rid := newTestRoomID(b)
+		p := pair{newTestClient(h), newTestClient(h)}
+		joinTestRoom(b, h, p.from, rid)
+		joinTestRoom(b, h, p.to, rid)
+		drain(p.from)
+		drain(p.to)
+		pairs[i] = p
+	}
+	candidate := []byte(`{"v":1,"type":"ice","payload":{"candidate":{"candidate":"candidate:842163049 1 udp 1677729535 203.0.113.7 54321 typ srflx raddr 10.0.0.2 rport 54321","sdpMid":"0","sdpMLineIndex":0}}}`)
+
+	var next atomic.Int64
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		p := pairs[next.Add(1)%rooms]
+		for pb.Next() {
+			h.handleMessage(p.from, candidate)
+			<-p.to.send
+		}
+	})
+}
+
+// A join turned away from an empty room leaves its grace period running,
+// so repeated rejected joins can't keep it from being reaped.
+func TestRejectedJoinKeepsEmptyRoomDeadline(t *testing.T) {
+	h := newTestHub(t)
+	rid, err := generateRoomID(1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The last one out keeps its seat, so the one-seat room is empty but full
+	a := newTestClient(h)
+	joinTestRoom(t, h, a, rid)
+	h.disconnect(a, leaveReasonDisconnected)
+	room, _ := h.rooms.get(rid)
+	room.mu.Lock()
+	emptySince := room.emptySince
+	room.mu.Unlock()
+	if emptySince.IsZero() {
+		t.Fatal("room not waiting out its grace period after the last member left")
+	}
+
+	b := newTestClient(h)
+	sendJSON(h, b, `{"v":1,"type":"join","rid":%q}`, rid)
+	assertErrorCode(t, b, ErrRoomFull)
+
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	if !room.emptySince.Equal(emptySince) {
+		t.Fatalf("emptySince = %v after a rejected join, want %v", room.emptySince, emptySince)
+	}
+}
+
+// MAX_ROOMS_PER_HOST caps the rooms one identity owns at once. Joining
+// someone else's room, or one it already owns, doesn't count against it.
+func TestMaxRoomsPerHost(t *testing.T) {
+	h := newTestHub(t)
+	h.maxRoomsPerHost = 2
+	h.emptyRoomGrace = 0
+
+	join := func(identity, rid string) *Client {
+		c := newTestClient(h)
+		c.identity = identity
+		sendJSON(h, c, `{"v":1,"type":"join","rid":%q}`, rid)
+		return c
+	}
+	joined := func(c *Client) {
+		t.Helper()
+		nextOfType(t, c, "joined")
+	}
+
+	owned := []string{newTestRoomID(t), newTestRoomID(t)}
+	first := join("alice", owned[0])
+	joined(first)
+	joined(join("alice", owned[1]))
+
+	third := newTestRoomID(t)
+	assertErrorCode(t, join("alice", third), ErrRoomQuotaExceeded)
+
+	// A guest in bob's room, and back in a room alice already owns
+	bobs := newTestRoomID(t)
+	joined(join("bob", bobs))
+	joined(join("alice", bobs))
+	first = join("alice", owned[0])
+	joined(first)
+
+	// Once one of alice's rooms is gone, she can open another
+	h.disconnect(first, leaveReasonLeft)
+	if _, ok := h.rooms.get(owned[0]); ok {
+		t.Fatal("emptied room still exists")
+	}
+	joined(join("alice", third))
+}
+
+// A handler that panics while holding a room lock costs only its sender
+// the connection. The lock is released on the way out, so the room and
+// everyone else in it carry on.
+func TestPanicUnderRoomLock(t *testing.T) {
+	h := newTestHub(t)
+	h.maxParticipants = 3
+	rid := newTestRoomID(t)
+
+	a, b := newTestClient(h), newTestClient(h)
+	joinTestRoom(t, h, a, rid)
+	room, _ := h.rooms.get(rid)
+
+	// Corrupt the room so b's join panics halfway through admitting it
+	room.mu.Lock()
+	joinedAt := room.JoinedAt
+	room.JoinedAt = nil
+	room.mu.Unlock()
+	sendJSON(h, b, `{"v":1,"type":"join","rid":%q}`, rid)
+
+	restored := make(chan struct{})
+	go func() {
+		room.mu.Lock()
+		defer room.mu.Unlock()
+		room.JoinedAt = joinedAt
+		close(restored)
+	}()
+	select {
+	case <-restored:
+	case <-time.After(5 * time.Second):
+		t.Fatal("room still locked after the panic")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !b.disconnected.Load() {
+		if time.Now().After(deadline) {
+			t.Fatal("panicking client never disconnected")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	b.msgMu.Lock()
+	b.msgMu.Unlock()
+	if a.disconnected.Load() {
+		t.Fatal("bystander disconnected")
+	}
+
+	drain(a)
+	sendJSON(h, a, `{"v":1,"type":"ping","payload":{}}`)
+	nextOfType(t, a, "pong")
+	joinTestRoom(t, h, newTestClient(h), rid)
+	nextOfType(t, a, "room_state")
+}
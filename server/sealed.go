@@ -0,0 +1,28 @@
+package main
+
+import "encoding/json"
+
+// A sealed message carries signaling that the clients encrypted with keys
+// they exchanged out of band. Its payload is a JSON string of base64 that
+// the server never decodes. It is relayed verbatim, with the sender in the
+// envelope's from instead of inside the payload.
+//
+//	{"v":1,"type":"sealed","rid":"...","to":"C-...","payload":"q83v..."}
+
+// validSealedPayload reports whether payload is a non-empty JSON string
+// holding only base64 characters (standard or URL-safe, padding allowed).
+// That is all the server checks.
+func validSealedPayload(payload json.RawMessage) bool {
+	if len(payload) < 3 || payload[0] != '"' || payload[len(payload)-1] != '"' {
+		return false
+	}
+	for _, b := range payload[1 : len(payload)-1] {
+		switch {
+		case b >= 'A' && b <= 'Z', b >= 'a' && b <= 'z', b >= '0' && b <= '9':
+		case b == '+', b == '/', b == '-', b == '_', b == '=':
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -1,15 +1,46 @@
 package main
 
 import (
+	"log"
 	"net/http"
 	"os"
 	"strings"
-)
+	"sync/atomic"
 
-var (
-	allowedOrigins = parseAllowedOrigins(os.Getenv("ALLOWED_ORIGINS"))
+	"github.com/joho/godotenv"
 )
 
+// allowedOrigins is swapped wholesale on reload, so readers never see a
+// partially updated list.
+var allowedOrigins atomic.Pointer[map[string]bool]
+
+// The .env files main loads, nearest first
+var dotenvFiles = []string{".env", "../.env"}
+
+// ALLOWED_ORIGINS as the process environment had it, before main loaded
+// the .env files into it
+var processAllowedOrigins, processAllowedOriginsSet = os.LookupEnv("ALLOWED_ORIGINS")
+
+// loadAllowedOrigins (re)reads ALLOWED_ORIGINS. Like godotenv.Load, the
+// process environment wins over the .env files. Otherwise the files are
+// read directly so that edits take effect on SIGHUP without a restart.
+func loadAllowedOrigins() {
+	raw := processAllowedOrigins
+	if !processAllowedOriginsSet {
+		for _, path := range dotenvFiles {
+			if env, err := godotenv.Read(path); err == nil {
+				if v, ok := env["ALLOWED_ORIGINS"]; ok {
+					raw = v
+					break
+				}
+			}
+		}
+	}
+	origins := parseAllowedOrigins(raw)
+	allowedOrigins.Store(&origins)
+	log.Printf("[CONFIG] Loaded %d allowed origins", len(origins))
+}
+
 func parseAllowedOrigins(raw string) map[string]bool {
 	origins := make(map[string]bool)
 	for _, origin := range strings.Split(raw, ",") {
@@ -23,11 +54,15 @@ func parseAllowedOrigins(raw string) map[string]bool {
 
 func isOriginAllowed(r *http.Request) bool {
 	origin := strings.TrimSpace(r.Header.Get("Origin"))
+	if origin == "" {
+		// Pre-RFC 6455 clients (hybi drafts up to 10) send this instead
+		origin = strings.TrimSpace(r.Header.Get("Sec-WebSocket-Origin"))
+	}
 	if origin == "" {
 		return true
 	}
 
-	if allowedOrigins[origin] {
+	if origins := allowedOrigins.Load(); origins != nil && (*origins)[origin] {
 		return true
 	}
 
@@ -46,3 +81,31 @@ func isOriginAllowed(r *http.Request) bool {
 
 	return false
 }
+
+// corsMiddleware rejects disallowed origins and echoes allowed ones back.
+// The origin is never a wildcard so that credentialed requests work.
+// Disallowed origins get no CORS headers at all. Preflight requests are
+// answered directly.
+func corsMiddleware(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// The response depends on Origin whether or not it is allowed
+		w.Header().Add("Vary", "Origin")
+		if !isOriginAllowed(r) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		origin := r.Header.Get("Origin")
+		if origin != "" {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+			w.Header().Set("Access-Control-Expose-Headers", requestIDHeader)
+		}
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Turn-Token, X-Admin-Token")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		h(w, r)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// withOriginsConfig points loadAllowedOrigins at a fresh .env file and the
+// given process environment for the duration of the test.
+func withOriginsConfig(t *testing.T, processValue string, processSet bool) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), ".env")
+	oldFiles, oldValue, oldSet := dotenvFiles, processAllowedOrigins, processAllowedOriginsSet
+	dotenvFiles = []string{path}
+	processAllowedOrigins, processAllowedOriginsSet = processValue, processSet
+	t.Cleanup(func() {
+		dotenvFiles, processAllowedOrigins, processAllowedOriginsSet = oldFiles, oldValue, oldSet
+		loadAllowedOrigins()
+	})
+	return path
+}
+
+func writeEnvFile(t *testing.T, path, origins string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte("ALLOWED_ORIGINS="+origins+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func originAllowed(origin string) bool {
+	r := httptest.NewRequest("GET", "/ws", nil)
+	r.Host = "signal.example"
+	r.Header.Set("Origin", origin)
+	return isOriginAllowed(r)
+}
+
+func TestAllowedOriginsPrecedence(t *testing.T) {
+	t.Run("process environment wins over .env", func(t *testing.T) {
+		path := withOriginsConfig(t, "https://env.example", true)
+		writeEnvFile(t, path, "https://file.example")
+		loadAllowedOrigins()
+		if !originAllowed("https://env.example") || originAllowed("https://file.example") {
+			t.Error("ALLOWED_ORIGINS from the process environment was overridden by .env")
+		}
+	})
+
+	t.Run(".env edits apply on reload", func(t *testing.T) {
+		path := withOriginsConfig(t, "", false)
+		writeEnvFile(t, path, "https://old.example")
+		loadAllowedOrigins()
+		if !originAllowed("https://old.example") {
+			t.Fatal("origin from .env not allowed")
+		}
+		writeEnvFile(t, path, "https://new.example")
+		loadAllowedOrigins()
+		if originAllowed("https://old.example") || !originAllowed("https://new.example") {
+			t.Error("reload didn't pick up the edited .env")
+		}
+	})
+}
+
+// Requests check origins while SIGHUP reloads swap the list. Run with -race.
+func TestAllowedOriginsReadWhileReload(t *testing.T) {
+	path := withOriginsConfig(t, "", false)
+	writeEnvFile(t, path, "https://stable.example")
+	loadAllowedOrigins()
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if !originAllowed("https://stable.example") {
+					t.Error("origin present in every version of the list was rejected")
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 200; i++ {
+		writeEnvFile(t, path, fmt.Sprintf("https://stable.example, https://extra-%d.example", i))
+		loadAllowedOrigins()
+	}
+	close(stop)
+	wg.Wait()
+
+	if !originAllowed("https://extra-199.example") || originAllowed("https://extra-198.example") {
+		t.Error("the last reload isn't the one in effect")
+	}
+}
+
+// Old clients that send Sec-WebSocket-Origin instead of Origin are held to
+// the same allow-list; Origin wins when both are present.
+func TestOriginHeaderVariants(t *testing.T) {
+	path := withOriginsConfig(t, "https://app.example", true)
+	writeEnvFile(t, path, "")
+	loadAllowedOrigins()
+
+	for _, tc := range []struct {
+		name, origin, secOrigin string
+		want                    bool
+	}{
+		{"no origin", "", "", true},
+		{"allowed Origin", "https://app.example", "", true},
+		{"disallowed Origin", "https://evil.example", "", false},
+		{"allowed Sec-WebSocket-Origin", "", "https://app.example", true},
+		{"disallowed Sec-WebSocket-Origin", "", "https://evil.example", false},
+		{"same-host Sec-WebSocket-Origin", "", "https://signal.example", true},
+		{"localhost Sec-WebSocket-Origin", "", "http://localhost:5173", true},
+		{"Origin wins when allowed", "https://app.example", "https://evil.example", true},
+		{"Origin wins when disallowed", "https://evil.example", "https://app.example", false},
+		{"blank Origin falls back", " ", "https://evil.example", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/ws", nil)
+			r.Host = "signal.example"
+			if tc.origin != "" {
+				r.Header.Set("Origin", tc.origin)
+			}
+			if tc.secOrigin != "" {
+				r.Header.Set("Sec-WebSocket-Origin", tc.secOrigin)
+			}
+			if got := isOriginAllowed(r); got != tc.want {
+				t.Errorf("isOriginAllowed = %v, want %v", got, tc.want)
+			}
+		})
+	}
+
+	// And on a real upgrade
+	h := newTestHub(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWs(h, w, r)
+	}))
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+	for origin, want := range map[string]int{"https://app.example": http.StatusSwitchingProtocols, "https://evil.example": http.StatusForbidden} {
+		header := http.Header{"Sec-WebSocket-Origin": {origin}}
+		conn, resp, err := websocket.DefaultDialer.Dial(url, header)
+		if conn != nil {
+			conn.Close()
+		}
+		if resp == nil {
+			t.Fatalf("Sec-WebSocket-Origin %s: %v", origin, err)
+		}
+		if resp.StatusCode != want {
+			t.Errorf("Sec-WebSocket-Origin %s: status %d, want %d", origin, resp.StatusCode, want)
+		}
+	}
+}
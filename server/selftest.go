@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// The self-test runs a canned call through the hub with two in-process
+// pseudo-clients, so an uptime monitor can check the signaling path
+// without a browser. The pseudo-clients have no transport; their send
+// channels are read directly. They use a freshly generated room ID and
+// aren't registered with the hub, and their messages are neither counted
+// in /api/stats nor reported to room event observers, so a monitor probing
+// every minute leaves no trace.
+const (
+	selftestTimeout = 5 * time.Second
+	selftestIP      = "selftest"
+)
+
+type selftestResult struct {
+	Pass       bool   `json:"pass"`
+	DurationMs int64  `json:"durationMs"`
+	FailedStep string `json:"failedStep,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// handleSelftest serves POST /api/selftest. It responds 200 with
+// {"pass": true} when every step was delivered in time, and 503 with the
+// failed step otherwise.
+func handleSelftest(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requireAdmin(w, r) {
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		start := time.Now()
+		step, err := hub.runSelftest(start.Add(selftestTimeout))
+		result := selftestResult{Pass: err == nil, DurationMs: time.Since(start).Milliseconds()}
+		status := http.StatusOK
+		if err != nil {
+			result.FailedStep = step
+			result.Error = err.Error()
+			status = http.StatusServiceUnavailable
+			log.Printf("[SELFTEST] Failed at %s: %v", step, err)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+// runSelftest joins two pseudo-clients to a throwaway room and relays an
+// offer, answer and ICE candidates in both directions. It returns the name
+// of the step that failed along with the error.
+func (h *Hub) runSelftest(deadline time.Time) (string, error) {
+	rid, err := generateRoomID(2, false)
+	if err != nil {
+		return "room_id", err
+	}
+	// Creating the room up front keeps probes off the per-IP room quota
+	room, _, _ := h.rooms.getOrCreate(rid)
+	defer h.rooms.delete(rid, room)
+
+	a := h.newSelftestClient()
+	b := h.newSelftestClient()
+	defer h.selftestSend(a, Message{Type: "leave", RID: rid})
+	defer h.selftestSend(b, Message{Type: "leave", RID: rid})
+
+	joinPayload := json.RawMessage(`{}`)
+	if joinAuthRequired() {
+		token, err := signJoinToken(joinClaims{Sub: "selftest", RID: rid, Exp: deadline.Add(time.Minute).Unix()})
+		if err != nil {
+			return "join", err
+		}
+		joinPayload, _ = json.Marshal(map[string]string{"token": token})
+	}
+	for _, c := range []*Client{a, b} {
+		h.selftestSend(c, Message{Type: "join", RID: rid, Payload: joinPayload})
+		if err := selftestExpect(c, "joined", deadline); err != nil {
+			return "join", err
+		}
+	}
+
+	steps := []struct {
+		msgType string
+		from    *Client
+		to      *Client
+		payload string
+	}{
+		{"offer", a, b, `{"sdp":"v=0 selftest offer"}`},
+		{"answer", b, a, `{"sdp":"v=0 selftest answer"}`},
+		{"ice", a, b, `{"candidate":"candidate:selftest"}`},
+		{"ice", b, a, `{"candidate":"candidate:selftest"}`},
+	}
+	for _, s := range steps {
+		h.selftestSend(s.from, Message{Type: s.msgType, RID: rid, To: s.to.cid, Payload: json.RawMessage(s.payload)})
+		if err := selftestExpect(s.to, s.msgType, deadline); err != nil {
+			return s.msgType, err
+		}
+	}
+	return "", nil
+}
+
+func (h *Hub) newSelftestClient() *Client {
+	return &Client{
+		hub:       h,
+		send:      make(chan outMessage, h.sendBuffer),
+		sid:       generateID("S-"),
+		ip:        selftestIP,
+		transport: selftestIP,
+		selftest:  true,
+		done:      make(chan struct{}),
+	}
+}
+
+func (h *Hub) selftestSend(c *Client, msg Message) {
+	msg.V = 1
+	data, _ := json.Marshal(msg)
+	h.handleMessage(c, data)
+}
+
+// selftestExpect waits for a message of msgType on c's queue, skipping
+// anything else (room_state, participant_joined, ...). An error message
+// fails the step immediately.
+func selftestExpect(c *Client, msgType string, deadline time.Time) error {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	for {
+		select {
+		case out := <-c.send:
+			var msg Message
+			if err := json.Unmarshal(out.data, &msg); err != nil {
+				return err
+			}
+			if msg.Type == msgType {
+				return nil
+			}
+			if msg.Type == "error" {
+				return fmt.Errorf("server error: %s", msg.Payload)
+			}
+		case <-timer.C:
+			return errors.New("timed out waiting for " + msgType)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// /api/selftest passes on a healthy hub without leaving a trace: no
+// message stats, no room events for observers or the replay history, and
+// no room left behind.
+func TestSelftest(t *testing.T) {
+	t.Setenv("ADMIN_TOKEN", "test-admin-token")
+	h := newTestHub(t)
+	h.events = newRoomObserverSet(8)
+	observer := &recordingObserver{}
+	h.events.add(observer)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/selftest", nil)
+	req.Header.Set("X-Admin-Token", "test-admin-token")
+	rec := httptest.NewRecorder()
+	handleSelftest(h)(rec, req)
+
+	var result selftestResult
+	if err := json.NewDecoder(rec.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK || !result.Pass {
+		t.Fatalf("selftest: status %d, %+v", rec.Code, result)
+	}
+	if stats := h.messages.snapshot(); len(stats) != 0 {
+		t.Errorf("selftest counted in message stats: %v", stats)
+	}
+	if len(observer.events) != 0 {
+		t.Errorf("selftest reported to observers: %+v", observer.events)
+	}
+	if backlog, _ := h.events.addAfter(&recordingObserver{}, 0); len(backlog) != 0 {
+		t.Errorf("selftest kept in event history: %+v", backlog)
+	}
+	if rooms := h.rooms.snapshot(); len(rooms) != 0 {
+		t.Errorf("%d rooms left behind", len(rooms))
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/api/selftest", nil)
+	rec = httptest.NewRecorder()
+	handleSelftest(h)(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("selftest without the admin token: status %d, want %d", rec.Code, http.StatusForbidden)
+	}
+}
@@ -1,206 +1,947 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"html"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
 
 	"github.com/gorilla/websocket"
+
+	"serenada/server/protocol"
 )
 
 // Constants
 const (
 	writeWait      = 10 * time.Second
-	pongWait       = 60 * time.Second
-	pingPeriod     = (pongWait * 9) / 10
 	maxMessageSize = 65536 // 64KB
+
+	// Consecutive dropped sends before the client is treated as a slow consumer
+	maxConsecutiveDrops = 3
+
+	// Rooms one multi-room connection can be in at once
+	maxRoomsPerConn = 16
+
+	// How often run sweeps for idle rooms
+	roomSweepInterval = time.Minute
+
+	// How often run checks for clients that stopped polling or ponging
+	clientReapInterval = 10 * time.Second
+
+	// Slack past the pong wait before the reaper evicts a WebSocket client.
+	// Normally the read deadline closes it first; the reaper catches
+	// connections whose reader is stuck.
+	wsReapMargin = 30 * time.Second
+
+	// How long clients of an ended room may stay connected to join another
+	roomEndedGrace = 5 * time.Second
+
+	// Delay between session_replaced and closing the replaced connection
+	replacedCloseDelay = time.Second
+
+	// Minimum gap between RELAY_RATE_LIMITED errors to one client, so the
+	// errors don't become a flood of their own
+	relayLimitedErrorInterval = time.Second
+
+	// Minimum gap between QUOTA_EXCEEDED errors to one client. The quota
+	// doesn't recover, so there's no point repeating it often
+	quotaExceededErrorInterval = 10 * time.Second
+
+	// App-level pings answered per second, and burst, per client
+	appPingRate  = 1
+	appPingBurst = 5
+
+	// get_state snapshots answered per second, and burst, per client
+	getStateRate  = 1
+	getStateBurst = 3
+
+	// Delay before re-sending room_state to a client whose buffer was full
+	roomStateRetryDelay = 250 * time.Millisecond
+
+	// Range of envelope versions (msg.V) the server accepts
+	minProtoVersion = 1
+	maxProtoVersion = 1
+)
+
+// Application-defined WebSocket close codes (4000-4999 range)
+const (
+	closeCodeSlowConsumer = 4001
+	closeCodeRoomEnded    = 4003
+	closeCodeKicked       = 4008
+	closeCodeReplaced     = 4009
+)
+
+// WebSocket keepalive, overridable via WS_PONG_WAIT / WS_PING_PERIOD
+var (
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = (wsPongWait * 9) / 10
+)
+
+// loadKeepaliveConfig applies keepalive overrides from the environment.
+// The ping period must be shorter than the pong wait, otherwise healthy
+// connections would time out between pings.
+func loadKeepaliveConfig() {
+	pongWait := envDuration("WS_PONG_WAIT", wsPongWait)
+	pingPeriod := envDuration("WS_PING_PERIOD", (pongWait*9)/10)
+	if pingPeriod >= pongWait {
+		log.Printf("[CONFIG] WS_PING_PERIOD (%s) must be less than WS_PONG_WAIT (%s), using %s", pingPeriod, pongWait, (pongWait*9)/10)
+		pingPeriod = (pongWait * 9) / 10
+	}
+	wsPongWait = pongWait
+	wsPingPeriod = pingPeriod
+}
+
+// Bounds for WS_READ_BUFFER / WS_WRITE_BUFFER
+const (
+	wsMinBufferSize = 256
+	wsMaxBufferSize = 65536
+)
+
+// loadBufferConfig sizes the per-connection WebSocket I/O buffers. Every
+// open connection holds both, so they trade memory across idle
+// connections for fewer syscalls on large messages: the 4096-byte write
+// default fits a typical SDP in one write, while reads stay at 1024
+// since clients mostly send small ICE candidates.
+func loadBufferConfig() {
+	for _, b := range []struct {
+		name string
+		size *int
+	}{
+		{"WS_READ_BUFFER", &upgrader.ReadBufferSize},
+		{"WS_WRITE_BUFFER", &upgrader.WriteBufferSize},
+	} {
+		n := envInt(b.name, *b.size)
+		if n < wsMinBufferSize || n > wsMaxBufferSize {
+			log.Printf("[CONFIG] %s must be %d-%d bytes, using %d", b.name, wsMinBufferSize, wsMaxBufferSize, *b.size)
+			continue
+		}
+		*b.size = n
+	}
+}
+
+// Per-type message size caps, checked before handling. maxMessageSize
+// (the connection read limit) remains the hard ceiling for every type.
+// Override with MESSAGE_SIZE_LIMITS, e.g. "ice=4096,offer=32768".
+var messageSizeLimits = map[string]int{
+	"offer":       32768,
+	"answer":      32768,
+	"ice":         4096,
+	"chat":        2048,
+	"renegotiate": 4096,
+	"broadcast":   2048,
+	"ping":        512,
+	"conn_state":  512,
+	"data":        4096,
+	"sealed":      49152, // a sealed offer is a 32KB SDP plus encryption overhead, base64-encoded
+}
+
+func loadMessageSizeLimits() {
+	raw := strings.TrimSpace(os.Getenv("MESSAGE_SIZE_LIMITS"))
+	if raw == "" {
+		return
+	}
+	for _, entry := range strings.Split(raw, ",") {
+		msgType, value, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		limit, err := strconv.Atoi(strings.TrimSpace(value))
+		if !ok || err != nil || limit <= 0 {
+			log.Printf("[CONFIG] Ignoring invalid MESSAGE_SIZE_LIMITS entry %q", entry)
+			continue
+		}
+		messageSizeLimits[strings.TrimSpace(msgType)] = limit
+	}
+}
+
+// WebSocket subprotocols pin the protocol version at the handshake.
+// serenada-bin is v1 with binary framing, so it's preferred when offered
+// alongside serenada-v1. The dotted name is what earlier docs recommended.
+const (
+	subprotocolV1       = "serenada-v1"
+	subprotocolV1Legacy = "serenada.signaling.v1"
 )
 
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
+	WriteBufferSize: 4096,
 	CheckOrigin: func(r *http.Request) bool {
 		return isOriginAllowed(r)
 	},
+	Subprotocols: []string{subprotocolBinary, subprotocolV1, subprotocolV1Legacy},
 }
 
-// Protocol structures
-type Message struct {
-	V       int             `json:"v"`
-	Type    string          `json:"type"`
-	RID     string          `json:"rid,omitempty"`
-	SID     string          `json:"sid,omitempty"`
-	CID     string          `json:"cid,omitempty"`
-	To      string          `json:"to,omitempty"`
-	Payload json.RawMessage `json:"payload,omitempty"`
+// subprotocolSupported reports whether the upgrade request either offers no
+// subprotocol or offers at least one the server speaks.
+func subprotocolSupported(r *http.Request) bool {
+	requested := websocket.Subprotocols(r)
+	if len(requested) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(requested, func(p string) bool {
+		return slices.Contains(upgrader.Subprotocols, p)
+	})
 }
 
-type Participant struct {
-	CID      string `json:"cid"`
-	JoinedAt int64  `json:"joinedAt,omitempty"`
-}
+// Protocol structures
+// The wire types live in the protocol package, shared with Go clients
+type (
+	Message     = protocol.Message
+	Participant = protocol.Participant
+	Departure   = protocol.Departure
+)
+
+const (
+	roleParticipant = protocol.RoleParticipant
+	roleObserver    = protocol.RoleObserver
+)
+
+// Reasons carried in participant_left (and room_ended) payloads
+const (
+	leaveReasonLeft         = "left"
+	leaveReasonDisconnected = "disconnected"
+	leaveReasonKicked       = "kicked"
+	leaveReasonHostEnded    = "host_ended"
+	leaveReasonTimeout      = "timeout" // connection went silent
+	leaveReasonSwitched     = "switched_rooms"
+	leaveReasonAdminClosed  = "admin_closed"
+	leaveReasonExpired      = "expired" // room reached ROOM_MAX_LIFETIME
+	leaveReasonAdminKick    = "admin_kick"
+)
 
 type Hub struct {
-	rooms    map[string]*Room
+	rooms    *roomStore
+	clients  *clientRegistry
+	ipConns  *IPConnCounter
 	watchers map[string]map[*Client]bool // roomID -> set of clients
-	mu       sync.RWMutex
-	clients  map[*Client]bool
+	mu       sync.RWMutex                // guards watchers
+
+	// Distinct new rooms each IP may create per hour
+	roomQuota *IPRoomQuota
+
+	// Live rooms one host identity may own at once; 0 disables the cap
+	maxRoomsPerHost int
+
+	// Empty rooms idle longer than this are deleted by the sweep
+	roomRetention time.Duration
+
+	// Rooms older than this are ended even if active; 0 disables the cap
+	roomMaxLifetime time.Duration
+
+	// What to do when a joiner's displayName is already used in the room
+	nicknamePolicy string
+
+	// How long a room that just emptied is kept for members to reconnect;
+	// 0 deletes it immediately
+	emptyRoomGrace time.Duration
+
+	// Maximum participants per room, observers excluded
+	maxParticipants int
+
+	// Joins into distinct rooms one connection may make per window
+	maxRoomSwitches  int
+	roomSwitchWindow time.Duration
+
+	// Relayed messages (offer/answer/ice) per second and burst, per client
+	relayRate  float64
+	relayBurst float64
+
+	// Data messages per second and burst, per client
+	dataRate  float64
+	dataBurst float64
+
+	// Bytes of data messages one room may relay in its lifetime (0 = no limit)
+	roomByteQuota int64
+
+	// Per-client outbound queue length. Larger absorbs bursts (ICE storms)
+	// before a client is closed as a slow consumer; smaller saves memory
+	// across many idle connections.
+	sendBuffer int
+
+	// ICE candidates queued longer than this are dropped instead of
+	// delivered; 0 disables the check
+	maxQueueAge time.Duration
+	// ICE candidates dropped for exceeding maxQueueAge
+	staleDrops atomic.Int64
+	// WebSocket connections closed because a write hit its deadline
+	writeTimeouts atomic.Int64
+
+	// Messages received from clients, by type
+	messages messageCounters
+
+	// Per-relay debug logging (LOG_RELAYS, LOG_REDACT_SDP)
+	relayLog relayLogConfig
+
+	// Out-of-band subscribers to room events
+	events *roomObserverSet
+
+	// Where room membership is snapshotted for crash recovery, if set
+	stateFile string
+
+	// Goroutines that write to WebSocket connections
+	writers *writerPool
 }
 
 type Room struct {
 	RID          string
 	Participants map[*Client]string // client -> cid
+	Observers    map[*Client]string // client -> cid, read-only members
+	JoinedAt     map[*Client]int64  // client -> unix ms of its join, members of either kind
+	DisplayNames map[*Client]string // client -> sanitized displayName, if one was given
+	ConnStates   map[*Client]string // participant -> last reported conn_state
 	HostCID      string
+	HostIdentity string    // stable owner identity (host token or JWT sub), if the first host had one
+	Capacity     int       // effective participant cap, set on first join
+	Label        string    // host-set display title, already sanitized
+	CreatedAt    time.Time // first join
+	LastActivity time.Time // last join/leave/relay
+	relaySeq     int64     // monotonic counter for relayed messages
+	dataBytes    int64     // bytes of data messages relayed, counted per recipient
 	mu           sync.Mutex
+
+	// Seats held for members of a room restored from STATE_FILE, or for the
+	// last member of a room in its empty grace period (cid -> role), and the
+	// host to restore
+	resumable   map[string]string
+	resumeHost  string
+	resumeUntil time.Time // held seats are released after this
+
+	// When the last member left, while the room waits out EMPTY_ROOM_GRACE;
+	// zero otherwise
+	emptySince time.Time
+
+	// Host-bound rooms keep one seat for the holder of the host token until
+	// that client is present
+	hostBound  bool
+	hostHolder *Client
+
+	// Offers relayed but not yet answered, keyed by (offerer, answerer) CID
+	pendingOffers map[[2]string]bool
+
+	// Set once the room is removed from the store, so a handler that looked
+	// it up just before can tell under room.mu
+	closed bool
+
+	// Messages received from members, by type; not guarded by mu
+	messages messageCounters
 }
 
+// Transports a Client can be connected over
+const (
+	TransportWS   = "ws"
+	TransportPoll = "poll"
+)
+
 type Client struct {
-	hub  *Hub
-	conn *websocket.Conn
-	send chan []byte
-	sid  string
-	cid  string // assigned on join
-	rid  string // current room
-	ip   string
+	hub       *Hub
+	conn      *websocket.Conn // nil for non-WebSocket transports
+	send      chan outMessage
+	sid       string
+	cid       string // assigned on join
+	rid       string // current room
+	ip        string
+	transport string
+	reqID     string // correlation ID of the request that opened the connection
+	binary    bool   // negotiated serenada-bin: MessagePack in binary frames
+	identity  string // user ID from a trusted gateway (IDENTITY_HEADER), if any
+	selftest  bool   // pseudo-client of /api/selftest, kept out of stats and room events
+
+	joins atomic.Int64 // successful joins, to detect a rejoin after room_ended
+
+	drops    atomic.Int32 // consecutive sends dropped on a full buffer
+	lastSeen atomic.Int64 // unix nano of the last poll request, or pong for WebSocket clients
+
+	done      chan struct{} // closed when a poll client is torn down
+	closeOnce sync.Once
+
+	// Serializes handleMessage. WebSocket reads are already sequential, but
+	// poll POSTs can overlap; a room switch must not interleave with a relay.
+	msgMu sync.Mutex
+
+	// Joins into a room other than the previous one, within the switch
+	// window. Guarded by msgMu.
+	lastJoinRID  string
+	roomSwitches []time.Time
+
+	// Per-client relay budget and when RELAY_RATE_LIMITED was last sent.
+	// Guarded by msgMu; the limiter is created on first relay.
+	relayLimiter     *SimpleTokenBucket
+	relayLimitedSent time.Time
+
+	// Budget for app-level pings. Guarded by msgMu, created on first ping.
+	pingLimiter *SimpleTokenBucket
+
+	// Budget for data messages, and when QUOTA_EXCEEDED was last sent.
+	// Guarded by msgMu, created on first use.
+	dataLimiter       *SimpleTokenBucket
+	quotaExceededSent time.Time
+
+	// Budget for get_state. Guarded by msgMu, created on first use.
+	stateLimiter *SimpleTokenBucket
+
+	disconnected atomic.Bool // set once handleDisconnect has run
+
+	caps atomic.Pointer[[]string] // capabilities negotiated via hello
+
+	// Rooms a multi-room client is in besides rid: rid -> cid. Handlers only
+	// look at rid/cid, so the membership a message names is swapped in
+	// before it's handled (see selectRoom).
+	otherRooms map[string]string
+	// Guards otherRooms. rid and cid are only changed with both msgMu and
+	// roomsMu held, so other goroutines read them under roomsMu.
+	roomsMu sync.Mutex
+
+	// Shared writer pool state (WebSocket only), see writer_pool.go
+	writeScheduled atomic.Bool
+	pingDue        atomic.Bool
+	writeFailed    atomic.Bool
 }
 
 func newHub() *Hub {
 	return &Hub{
-		rooms:    make(map[string]*Room),
+		rooms:    newRoomStore(),
+		clients:  newClientRegistry(),
+		ipConns:  NewIPConnCounter(envInt("MAX_CONNS_PER_IP", 20)),
 		watchers: make(map[string]map[*Client]bool),
-		clients:  make(map[*Client]bool),
+
+		roomQuota:       NewIPRoomQuota(envInt("MAX_ROOMS_PER_IP", 30), time.Hour),
+		maxRoomsPerHost: envInt("MAX_ROOMS_PER_HOST", 0),
+
+		roomRetention:   envDuration("ROOM_RETENTION", time.Hour),
+		roomMaxLifetime: envDuration("ROOM_MAX_LIFETIME", 0),
+		emptyRoomGrace:  envDurationOrOff("EMPTY_ROOM_GRACE", 10*time.Second),
+		nicknamePolicy:  loadNicknamePolicy(),
+		maxParticipants: max(1, envInt("MAX_PARTICIPANTS", 2)),
+		sendBuffer:      max(1, envInt("SEND_BUFFER", 256)),
+		maxQueueAge:     envDurationOrOff("MAX_QUEUE_AGE", 5*time.Second),
+
+		maxRoomSwitches:  envInt("MAX_ROOM_SWITCHES", 20),
+		roomSwitchWindow: envDuration("ROOM_SWITCH_WINDOW", time.Minute),
+
+		relayRate:  float64(max(1, envInt("RELAY_RATE", 50))),
+		relayBurst: float64(max(1, envInt("RELAY_BURST", 200))),
+
+		dataRate:  float64(max(1, envInt("DATA_RATE", 20))),
+		dataBurst: float64(max(1, envInt("DATA_BURST", 40))),
+
+		roomByteQuota: int64(envInt("ROOM_BYTE_QUOTA", 0)),
+
+		relayLog: loadRelayLogConfig(),
+
+		events: newRoomObserverSet(eventHistorySize()),
+
+		stateFile: strings.TrimSpace(os.Getenv("STATE_FILE")),
+
+		writers: newWriterPool(max(1, envInt("WS_WRITERS", 64))),
 	}
 }
 
+// run does periodic maintenance on a single goroutine. Clients are added
+// to and removed from the registry by the goroutine that connects or
+// disconnects them, so a removal can never overtake its add. Room
+// operations (join/leave/relay) are handled directly by the reading
+// goroutine under the per-room and per-shard locks.
 func (h *Hub) run() {
-	// Simple run loop if needed, for MVP we handle events directly
+	sweepTicker := time.NewTicker(roomSweepInterval)
+	defer sweepTicker.Stop()
+	reapTicker := time.NewTicker(clientReapInterval)
+	defer reapTicker.Stop()
+	pingTicker := time.NewTicker(wsPingPeriod)
+	defer pingTicker.Stop()
+	resumeTicker := time.NewTicker(resumeTokenRefresh)
+	defer resumeTicker.Stop()
+	var stateTick <-chan time.Time
+	if h.stateFile != "" {
+		stateTicker := time.NewTicker(stateSnapshotInterval)
+		defer stateTicker.Stop()
+		stateTick = stateTicker.C
+	}
+
+	for {
+		select {
+		case <-sweepTicker.C:
+			h.sweepRooms()
+			h.roomQuota.Cleanup()
+		case <-reapTicker.C:
+			h.reapStaleClients()
+			h.reapEmptyRooms()
+		case <-pingTicker.C:
+			h.schedulePings()
+		case <-resumeTicker.C:
+			h.refreshResumeTokens()
+		case <-stateTick:
+			if err := h.saveState(h.stateFile); err != nil {
+				log.Printf("[STATE] Failed to save %s: %v", h.stateFile, err)
+			}
+		}
+	}
+}
+
+// reapStaleClients evicts clients that went quiet. Poll clients are closed
+// once they haven't polled for pollStaleTimeout. WebSocket clients should
+// have been closed by the pong deadline in readPump; one without a pong for
+// wsPongWait + wsReapMargin is taken to have a wedged reader, so its conn is
+// closed and the disconnect run here.
+func (h *Hub) reapStaleClients() {
+	now := time.Now()
+	pollCutoff := now.Add(-pollStaleTimeout).UnixNano()
+	wsCutoff := now.Add(-wsPongWait - wsReapMargin).UnixNano()
+	for _, c := range h.clients.snapshot() {
+		switch {
+		case c.transport == TransportPoll && c.lastSeen.Load() < pollCutoff:
+			log.Printf("[REAPER] Evicting stale %s client %s (req %s)", c.transport, c.sid, c.reqID)
+			c.closeFor(leaveReasonTimeout)
+		case c.transport == TransportWS && c.lastSeen.Load() < wsCutoff:
+			// The read deadline should have closed it already, so its
+			// readPump may never run the disconnect; do it here
+			log.Printf("[REAPER] Evicting stale %s client %s (req %s)", c.transport, c.sid, c.reqID)
+			c.conn.Close()
+			go h.disconnect(c, leaveReasonTimeout)
+		}
+	}
+}
+
+// reapEmptyRooms deletes rooms that have stayed empty for the grace period.
+// A join in the meantime clears emptySince, cancelling the deletion.
+func (h *Hub) reapEmptyRooms() {
+	cutoff := time.Now().Add(-h.emptyRoomGrace)
+	deleted := h.rooms.sweep(func(room *Room) bool {
+		return len(room.Participants) == 0 && len(room.Observers) == 0 &&
+			!room.emptySince.IsZero() && room.emptySince.Before(cutoff)
+	})
+	for _, rid := range deleted {
+		log.Printf("[REAPER] Deleted room %s after its empty grace period", rid)
+		h.broadcastRoomStatusUpdate(rid)
+	}
+}
+
+// sweepRooms is a safety net for rooms that were left behind empty,
+// deleting them once they've been idle longer than the retention period.
+func (h *Hub) sweepRooms() {
+	cutoff := time.Now().Add(-h.roomRetention)
+	deleted := h.rooms.sweep(func(room *Room) bool {
+		return len(room.Participants) == 0 && len(room.Observers) == 0 && room.LastActivity.Before(cutoff)
+	})
+	for _, rid := range deleted {
+		log.Printf("[SWEEP] Deleted idle room %s", rid)
+		h.broadcastRoomStatusUpdate(rid)
+	}
+
+	// Long-lived rooms are ended regardless of activity, so clients
+	// eventually rejoin fresh rather than keep one room forever
+	if h.roomMaxLifetime <= 0 {
+		return
+	}
+	cutoff = time.Now().Add(-h.roomMaxLifetime)
+	for _, room := range h.rooms.snapshot() {
+		expired := func() bool {
+			room.mu.Lock()
+			defer room.mu.Unlock()
+			return room.CreatedAt.Before(cutoff)
+		}()
+		if expired {
+			log.Printf("[SWEEP] Room %s reached its max lifetime", room.RID)
+			h.endRoom(room, "server", leaveReasonExpired)
+		}
+	}
 }
 
 func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+	ip := getClientIP(r)
+	if !subprotocolSupported(r) {
+		log.Printf("[CONNECT] Rejected upgrade from %s: unsupported subprotocols %q", ip, websocket.Subprotocols(r))
+		http.Error(w, "Unsupported WebSocket subprotocol", http.StatusBadRequest)
+		return
+	}
+	if !hub.ipConns.Acquire(ip) {
+		http.Error(w, "429 Too Many Requests", http.StatusTooManyRequests)
+		log.Printf("Connection limit exceeded for IP: %s", ip)
+		return
+	}
+
+	// The upgrade writes its own response, so pass the ID along explicitly
+	conn, err := upgrader.Upgrade(w, r, http.Header{requestIDHeader: {requestID(r)}})
 	if err != nil {
+		hub.ipConns.Release(ip)
 		log.Println(err)
 		return
 	}
 
-	ip := getClientIP(r)
 	sid := generateID("S-")
-	client := &Client{hub: hub, conn: conn, send: make(chan []byte, 256), sid: sid, ip: ip}
+	client := &Client{hub: hub, conn: conn, send: make(chan outMessage, hub.sendBuffer), sid: sid, ip: ip, transport: TransportWS, reqID: requestID(r)}
+	client.binary = conn.Subprotocol() == subprotocolBinary
+	client.identity = headerIdentity(r)
+	client.lastSeen.Store(time.Now().UnixNano())
 
-	hub.mu.Lock()
-	hub.clients[client] = true
-	hub.mu.Unlock()
+	hub.clients.add(client)
+	log.Printf("[CONNECT] Client %s connected from %s (req %s)", sid, ip, client.reqID)
 
-	go client.writePump()
 	go client.readPump()
 }
 
 func (c *Client) readPump() {
+	reason := leaveReasonDisconnected
 	defer func() {
-		c.hub.handleDisconnect(c)
+		c.hub.disconnect(c, reason)
 		c.conn.Close()
 	}()
 	c.conn.SetReadLimit(maxMessageSize)
-	c.conn.SetReadDeadline(time.Now().Add(pongWait))
-	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
+	c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	c.conn.SetPongHandler(func(string) error {
+		c.lastSeen.Store(time.Now().UnixNano())
+		c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		return nil
+	})
 
 	for {
-		_, message, err := c.conn.ReadMessage()
+		msgType, message, err := c.conn.ReadMessage()
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("error: %v", err)
-			}
+			reason = c.readErrorReason(err)
 			break
 		}
+		if msgType == websocket.BinaryMessage && c.binary {
+			if message, err = msgpackToJSON(message); err != nil {
+				c.sendError("", ErrBadRequest, "Invalid msgpack")
+				continue
+			}
+		}
 		c.hub.handleMessage(c, message)
 	}
 }
 
-func (c *Client) writePump() {
-	ticker := time.NewTicker(pingPeriod)
-	defer func() {
-		ticker.Stop()
-		c.conn.Close()
-	}()
-	for {
-		select {
-		case message, ok := <-c.send:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if !ok {
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
-
-			w, err := c.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				return
-			}
-			w.Write(message)
-
-			// Coalescing disabled to prevent JSON parsing errors on client
-			// if multiple messages are sent in one frame.
-
-			if err := w.Close(); err != nil {
-				return
-			}
-		case <-ticker.C:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
-				return
-			}
-		}
+// readErrorReason classifies the error that ended readPump and logs it
+// at a level matching how expected it is.
+func (c *Client) readErrorReason(err error) string {
+	var netErr net.Error
+	switch {
+	case websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway):
+		// Clean close by the client
+	case errors.As(err, &netErr) && netErr.Timeout():
+		log.Printf("[READ] Client %s (req %s, CID: %s) timed out: %v", c.sid, c.reqID, c.cid, err)
+		return leaveReasonTimeout
+	case websocket.IsUnexpectedCloseError(err, websocket.CloseAbnormalClosure):
+		log.Printf("[READ] Client %s (req %s, CID: %s) protocol error: %v", c.sid, c.reqID, c.cid, err)
 	}
+	return leaveReasonDisconnected
 }
 
-func (c *Client) sendMessage(msg interface{}) {
-	b, err := json.Marshal(msg)
+// sendMessage queues msg for c without blocking and reports whether it
+// was queued.
+func (c *Client) sendMessage(msg interface{}) bool {
+	b, err := c.encodeMessage(msg)
 	if err != nil {
 		log.Printf("json error: %v", err)
-		return
+		return false
+	}
+	out := outMessage{data: b}
+	if m, ok := msg.(Message); ok && m.Type == "ice" && c.hub.maxQueueAge > 0 {
+		out.expires = time.Now().Add(c.hub.maxQueueAge)
 	}
 	select {
-	case c.send <- b:
+	case c.send <- out:
+		c.drops.Store(0)
+		if c.conn != nil {
+			c.hub.writers.schedule(c)
+		}
+		return true
 	default:
-		// Buffer full, drop or close
+		// Buffer full. A client that keeps falling behind would silently lose
+		// offers/candidates, so close it instead of limping along. The close
+		// frame waits for the writer stuck on this peer, and callers may hold
+		// a room lock or be the hub's run loop, so it's sent asynchronously.
+		if c.drops.Add(1) == maxConsecutiveDrops {
+			log.Printf("[SLOW_CONSUMER] Client %s (req %s, CID: %s) dropped %d messages in a row. Closing", c.sid, c.reqID, c.cid, maxConsecutiveDrops)
+			go c.closeWith(closeCodeSlowConsumer, "SLOW_CONSUMER")
+		}
+		return false
+	}
+}
+
+// selectRoom makes c's membership in rid current, parking the current one.
+// It does nothing unless c is a multi-room client already in rid.
+func (c *Client) selectRoom(rid string) {
+	c.roomsMu.Lock()
+	defer c.roomsMu.Unlock()
+	cid, ok := c.otherRooms[rid]
+	if !ok {
+		return
+	}
+	delete(c.otherRooms, rid)
+	if c.rid != "" {
+		c.otherRooms[c.rid] = c.cid
+	}
+	c.rid, c.cid = rid, cid
+}
+
+// currentRID returns c.rid for goroutines other than c's message handlers.
+func (c *Client) currentRID() string {
+	c.roomsMu.Lock()
+	defer c.roomsMu.Unlock()
+	return c.rid
+}
+
+// memberships returns every room c is in, current and parked: rid -> cid.
+func (c *Client) memberships() map[string]string {
+	c.roomsMu.Lock()
+	defer c.roomsMu.Unlock()
+	rooms := make(map[string]string, len(c.otherRooms)+1)
+	for rid, cid := range c.otherRooms {
+		rooms[rid] = cid
+	}
+	if c.rid != "" {
+		rooms[c.rid] = c.cid
+	}
+	return rooms
+}
+
+// parkRoom sets c's current membership aside so c can join another room
+// without leaving it. It fails once c is in maxRoomsPerConn rooms.
+func (c *Client) parkRoom() bool {
+	c.roomsMu.Lock()
+	defer c.roomsMu.Unlock()
+	if len(c.otherRooms)+1 >= maxRoomsPerConn {
+		return false
+	}
+	if c.otherRooms == nil {
+		c.otherRooms = make(map[string]string)
+	}
+	c.otherRooms[c.rid] = c.cid
+	c.rid, c.cid = "", ""
+	return true
+}
+
+// nextRoom makes one of c's parked memberships current, if it has any.
+func (c *Client) nextRoom() bool {
+	c.roomsMu.Lock()
+	defer c.roomsMu.Unlock()
+	for rid, cid := range c.otherRooms {
+		delete(c.otherRooms, rid)
+		c.rid, c.cid = rid, cid
+		return true
+	}
+	return false
+}
+
+// dropRoom forgets c's membership in rid after it was removed from it.
+func (c *Client) dropRoom(rid string) {
+	c.roomsMu.Lock()
+	defer c.roomsMu.Unlock()
+	delete(c.otherRooms, rid)
+	if c.rid == rid {
+		c.rid = ""
+		c.cid = ""
+	}
+}
+
+// forgetRoom forgets a parked membership in an ended room and reports
+// whether c is still in another room. A current membership is left as is,
+// like for single-room clients.
+func (c *Client) forgetRoom(rid string) bool {
+	c.roomsMu.Lock()
+	defer c.roomsMu.Unlock()
+	delete(c.otherRooms, rid)
+	return len(c.otherRooms) > 0 || (c.rid != "" && c.rid != rid)
+}
+
+// outMessage is an encoded message waiting in a client's send queue.
+type outMessage struct {
+	data    []byte
+	expires time.Time // zero for messages that never go stale
+}
+
+// stale reports whether m sat in c's queue too long to be worth delivering,
+// counting the drop if so. Only ICE candidates expire: a late one is
+// useless, while a late offer or answer still matters.
+func (c *Client) stale(m outMessage) bool {
+	if m.expires.IsZero() || time.Now().Before(m.expires) {
+		return false
+	}
+	c.hub.staleDrops.Add(1)
+	return true
+}
+
+// closeUnlessRejoined closes c with ROOM_ENDED after grace unless it has
+// joined a room in the meantime, so clients of an ended room don't linger.
+func (c *Client) closeUnlessRejoined(grace time.Duration) {
+	joins := c.joins.Load()
+	time.AfterFunc(grace, func() {
+		if c.joins.Load() == joins {
+			c.closeWith(closeCodeRoomEnded, "ROOM_ENDED")
+		}
+	})
+}
+
+// closeWith sends a close frame carrying code and reason (WebSocket only)
+// before tearing the connection down, so the client can tell why it was closed.
+func (c *Client) closeWith(code int, reason string) {
+	if c.conn != nil {
+		c.conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(code, reason),
+			time.Now().Add(writeWait))
+	}
+	c.close()
+}
+
+// close tears down the client's transport. For WebSocket clients closing the
+// conn makes readPump exit, which runs handleDisconnect. Poll clients have no
+// reader goroutine, so the disconnect is run here (asynchronously, since close
+// may be called from the hub's run loop).
+func (c *Client) close() {
+	c.closeFor(leaveReasonDisconnected)
+}
+
+// closeFor is close with the leave reason reported for poll clients.
+// WebSocket clients get theirs from the read error in readPump.
+func (c *Client) closeFor(reason string) {
+	if c.conn != nil {
+		c.conn.Close()
+		return
 	}
+	c.closeOnce.Do(func() {
+		close(c.done)
+		go c.hub.disconnect(c, reason)
+	})
 }
 
 // Logic
 
 func (h *Hub) handleMessage(c *Client, msgBytes []byte) {
+	c.msgMu.Lock()
+	defer c.msgMu.Unlock()
+
+	// A poll request that raced the disconnect must not rejoin anything
+	if c.disconnected.Load() {
+		return
+	}
+
+	// A handler bug costs the sender its connection, not the whole server
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("[PANIC] Handling message from client %s (req %s, CID: %s, room %s): %v\n%s", c.sid, c.reqID, c.cid, c.rid, r, debug.Stack())
+			c.close()
+		}
+	}()
+
+	if err := checkJSONLimits(msgBytes); err != nil {
+		if errors.Is(err, errJSONTooDeep) || errors.Is(err, errJSONTooManyKeys) {
+			log.Printf("[TOO_COMPLEX] Client %s (req %s) sent a message over the JSON limits: %v", c.sid, c.reqID, err)
+			c.sendError("", ErrBadRequest, "Message is too deeply nested or has too many keys")
+			return
+		}
+		c.sendError("", ErrBadRequest, "Invalid JSON")
+		return
+	}
+
 	var msg Message
-	if err := json.Unmarshal(msgBytes, &msg); err != nil {
-		c.sendError(msg.RID, "BAD_REQUEST", "Invalid JSON")
+	if err := decodeMessage(msgBytes, &msg); err != nil {
+		c.sendError(msg.RID, ErrBadRequest, "Invalid JSON")
+		return
+	}
+
+	if msg.V < minProtoVersion || msg.V > maxProtoVersion {
+		c.sendErrorDetails(msg.RID, ErrUnsupportedVersion, "Protocol version not supported", map[string]int{
+			"minVersion": minProtoVersion,
+			"maxVersion": maxProtoVersion,
+		})
 		return
 	}
 
-	if msg.V != 1 {
-		c.sendError(msg.RID, "UNSUPPORTED_VERSION", "Only version 1 is supported")
+	if limit, ok := messageSizeLimits[msg.Type]; ok && len(msgBytes) > limit {
+		log.Printf("[TOO_LARGE] Client %s (req %s) sent %d byte %s message (limit %d)", c.sid, c.reqID, len(msgBytes), msg.Type, limit)
+		c.sendError(msg.RID, ErrMessageTooLarge, "Message exceeds size limit for its type")
 		return
 	}
 
+	// A multi-room client's message applies to the room it names
+	if msg.RID != "" && msg.RID != c.rid {
+		c.selectRoom(msg.RID)
+	}
+
+	if !c.selftest {
+		h.messages.add(msg.Type, len(msgBytes))
+	}
+	if c.rid != "" {
+		if room, ok := h.rooms.get(c.rid); ok {
+			room.messages.add(msg.Type, len(msgBytes))
+		}
+	}
+
 	switch msg.Type {
 	case "join":
-		log.Printf("[JOIN] Client %s joining room %s", c.sid, msg.RID)
+		log.Printf("[JOIN] Client %s (req %s) joining room %s", c.sid, c.reqID, msg.RID)
+		if !h.allowRoomSwitch(c, msg.RID) {
+			log.Printf("[JOIN] Client %s (req %s) switched rooms too often", c.sid, c.reqID)
+			c.sendError(msg.RID, ErrTooManyRoomSwitches, "Too many room switches on this connection")
+			return
+		}
 		if c.rid != "" {
-			h.removeClientFromRoom(c)
+			if msg.RID != c.rid && c.hasCap(capMultiRoom) {
+				// Joining another room keeps this one
+				if !c.parkRoom() {
+					c.sendError(msg.RID, ErrBadRequest, "Too many rooms on this connection")
+					return
+				}
+			} else {
+				reason := leaveReasonLeft
+				if msg.RID != c.rid {
+					reason = leaveReasonSwitched
+				}
+				h.removeClientFromRoom(c, reason)
+			}
 		}
 		h.handleJoin(c, msg)
+		if c.rid == "" {
+			// The join failed; fall back to a room the client is still in
+			c.nextRoom()
+		}
 	case "leave":
-		log.Printf("[LEAVE] Client %s leaving", c.cid)
+		log.Printf("[LEAVE] Client %s (req %s, CID: %s) leaving", c.sid, c.reqID, c.cid)
 		h.handleLeave(c, msg)
 	case "end_room":
-		log.Printf("[END_ROOM] Client %s ending room %s", c.cid, c.rid)
+		log.Printf("[END_ROOM] Client %s (req %s, CID: %s) ending room %s", c.sid, c.reqID, c.cid, c.rid)
 		h.handleEndRoom(c, msg)
+	case "hello":
+		h.handleHello(c, msg)
 	case "watch_rooms":
 		h.handleWatchRooms(c, msg)
-	case "offer", "answer", "ice":
-		// log.Printf("[%s] Relay from %s to room %s", msg.Type, c.cid, c.rid) // verbose
+	case "promote":
+		h.handlePromote(c, msg)
+	case "set_label":
+		h.handleSetLabel(c, msg)
+	case "request_mute":
+		h.handleRequestMute(c, msg)
+	case "broadcast":
+		h.handleBroadcast(c, msg)
+	case "ping":
+		h.handlePing(c, msg)
+	case "get_state":
+		h.handleGetState(c, msg)
+	case "data":
+		h.handleData(c, msg)
+	case "conn_state":
+		h.handleConnState(c, msg)
+	case "offer", "answer", "ice", "renegotiate":
+		if h.relayLog.enabled {
+			log.Printf("[%s] Relay from %s (req %s) to room %s: %s", strings.ToUpper(msg.Type), c.cid, c.reqID, c.rid, h.relayLog.relayLogPayload(msg.Payload))
+		}
+		h.handleRelay(c, msg)
+	case "sealed":
+		// The payload is opaque, so the relay log only notes its size
+		if h.relayLog.enabled {
+			log.Printf("[SEALED] Relay from %s (req %s) to room %s: %d bytes", c.cid, c.reqID, c.rid, len(msg.Payload))
+		}
 		h.handleRelay(c, msg)
 	default:
 		log.Printf("[UNKNOWN] Unknown message type: %s", msg.Type)
@@ -210,299 +951,1288 @@ func (h *Hub) handleMessage(c *Client, msgBytes []byte) {
 func (h *Hub) handleJoin(c *Client, msg Message) {
 	rid := msg.RID
 	if rid == "" {
-		c.sendError("", "BAD_REQUEST", "Missing roomId")
+		c.sendError("", ErrBadRequest, "Missing roomId")
 		return
 	}
 
-	if err := validateRoomID(rid); err != nil {
+	idInfo, err := parseRoomID(rid)
+	if err != nil {
 		if errors.Is(err, ErrRoomIDSecretMissing) {
-			c.sendError(rid, "SERVER_NOT_CONFIGURED", "Room ID service is not configured")
+			c.sendError(rid, ErrServerNotConfigured, "Room ID service is not configured")
 			return
 		}
-		c.sendError(rid, "INVALID_ROOM_ID", "Room ID must be a valid room token")
+		c.sendError(rid, ErrInvalidRoomID, "Room ID must be a valid room token")
 		return
 	}
 
-	h.mu.Lock()
-	room, exists := h.rooms[rid]
-	if !exists {
-		log.Printf("[JOIN] Creating new room %s", rid)
-		room = &Room{
-			RID:          rid,
-			Participants: make(map[*Client]string),
+	var joinPayload struct {
+		ResumeToken string `json:"resumeToken"`
+		Role        string `json:"role"`
+		Token       string `json:"token"`
+		DisplayName string `json:"displayName"`
+		HostToken   string `json:"hostToken"`
+	}
+	if len(msg.Payload) > 0 {
+		if err := json.Unmarshal(msg.Payload, &joinPayload); err != nil {
+			log.Printf("[JOIN] Failed to parse payload: %v", err)
 		}
-		h.rooms[rid] = room
 	}
-	h.mu.Unlock()
+	hostHolder := idInfo.hostBound && validHostToken(rid, joinPayload.HostToken)
 
-	room.mu.Lock()
-	// Checks...
-	if len(room.Participants) >= 2 {
-		// Room is full. Check for reconnection/ghost eviction.
-		// Parse payload for reconnectCid
-		var joinPayload struct {
-			ReconnectCID string `json:"reconnectCid"`
-		}
-		if len(msg.Payload) > 0 {
-			if err := json.Unmarshal(msg.Payload, &joinPayload); err != nil {
-				log.Printf("[JOIN] Failed to parse payload: %v", err)
-			}
+	// Only a signed resume token can reclaim a seat; a bare cid is just a guess
+	reconnectCID := ""
+	if joinPayload.ResumeToken != "" {
+		if cid, ok := verifyResumeToken(joinPayload.ResumeToken, rid); ok {
+			reconnectCID = cid
+		} else {
+			log.Printf("[JOIN] Client %s (req %s) presented an invalid or expired resume token for room %s", c.sid, c.reqID, rid)
 		}
+	}
 
-		reconnectCID := joinPayload.ReconnectCID
-		evicted := false
+	// A stable identity, if the joiner has one, lets a host reclaim the
+	// role across reconnects
+	identity := ""
+	if hostHolder {
+		identity = hostIdentityToken
+	}
 
-		if reconnectCID != "" {
-			var ghostClient *Client
-			for client, cid := range room.Participants {
-				if cid == reconnectCID {
-					ghostClient = client
-					break
-				}
-			}
+	// A gateway- or JWT-verified user ID becomes the cid (see identity.go)
+	externalCID := c.identity
 
-			if ghostClient != nil {
-				log.Printf("[JOIN] Reconnection detected for CID %s. Evicting ghost client %s", reconnectCID, ghostClient.sid)
-				// Evict ghost. MUST unlock room before calling removeClientFromRoom because it locks hub then room.
-				// Wait, removeClientFromRoom locks hub then room. We currently hold room lock.
-				// We CANNOT call removeClientFromRoom here directly without deadlock or complex unlocking.
-				// Alternative: Mark for removal, unlock, remove, retry join?
-				// Or: Just remove from room.Participants manually here?
-				// Removing manually requires updating Hub.watchers and Hub.rooms if empty, which needs Hub lock.
-				// We do NOT hold Hub lock here (unlocked at line 238).
-
-				// Best strategy: Unlock, remove ghost, retry logic?
-				// But we are in middle of function.
-
-				// Let's do this: Release room lock, call removeClientFromRoom, re-acquire room lock.
-				room.mu.Unlock()
-
-				// We need to ensure we don't race.
-				// Actually, handleDisconnect might be running for ghost.
-				h.removeClientFromRoom(ghostClient)
-
-				room.mu.Lock()
-				// Re-check state after re-lock
-				if len(room.Participants) >= 2 {
-					// Still full? Maybe someone else joined or ghost removal failed (already gone).
-					// If ghost is gone, len should be < 2.
-					// Let's just fall through to check again.
-				} else {
-					evicted = true
-				}
-			}
+	if joinAuthRequired() {
+		claims, err := verifyJoinToken(joinPayload.Token, rid)
+		if err != nil {
+			log.Printf("[JOIN] Client %s (req %s) rejected from room %s: %v", c.sid, c.reqID, rid, err)
+			c.sendError(rid, ErrUnauthorized, "A valid join token is required")
+			return
 		}
-
-		if !evicted && len(room.Participants) >= 2 {
-			room.mu.Unlock()
-			log.Printf("[JOIN] Room %s is full", rid)
-			c.sendError(rid, "ROOM_FULL", "Room is full")
+		log.Printf("[JOIN] Client %s (req %s) authenticated as %s", c.sid, c.reqID, claims.Sub)
+		if identity == "" && claims.Sub != "" {
+			identity = "sub:" + claims.Sub
+		}
+		if claims.CID != "" {
+			externalCID = claims.CID
+		}
+	}
+	if externalCID != "" {
+		if !validExternalCID(externalCID) {
+			log.Printf("[JOIN] Client %s (req %s) rejected from room %s: invalid identity %q", c.sid, c.reqID, rid, externalCID)
+			c.sendError(rid, ErrUnauthorized, "Identity is not a valid participant ID")
 			return
 		}
+		if identity == "" {
+			identity = "cid:" + externalCID
+		}
+		// The identity is the seat, whatever resume token came with it
+		reconnectCID = externalCID
+	}
+
+	role := joinPayload.Role
+	if role == "" {
+		role = roleParticipant
+	}
+	if role != roleParticipant && role != roleObserver {
+		c.sendError(rid, ErrBadRequest, "Unknown role")
+		return
+	}
+
+	// Joining an existing room is unlimited; creating one counts against the IP's quota
+	if _, exists := h.rooms.get(rid); !exists && !h.roomQuota.Allow(c.ip, rid) {
+		log.Printf("[JOIN] Client %s (req %s, IP %s) exceeded room creation quota", c.sid, c.reqID, c.ip)
+		c.sendError(rid, ErrRoomQuotaExceeded, "Too many new rooms created, try again later")
+		return
+	}
+
+	// Counted before the room lock is taken, since it locks other rooms
+	ownedRooms := 0
+	if h.maxRoomsPerHost > 0 && role == roleParticipant && identity != "" && identity != hostIdentityToken {
+		ownedRooms = h.roomsOwnedBy(identity, rid)
+	}
+
+	room, created, emptySince := h.rooms.getOrCreate(rid)
+	if created {
+		log.Printf("[JOIN] Creating new room %s", rid)
+		// Turned away before anyone joined, it's reaped like an emptied room
+		emptySince = time.Now()
+	}
+
+	var (
+		cid, displayName, hostCid, initiatorCid, label string
+		joinedAt                                       int64
+		participants, observers                        []Participant
+		capacity                                       int
+		replaced                                       *Client
+	)
+	// Held with a deferred unlock: a panicking handler (see handleMessage)
+	// must not leave the room locked.
+	admitted := func() bool {
+		room.mu.Lock()
+		defer room.mu.Unlock()
+		if room.Capacity == 0 {
+			room.Capacity = h.roomCapacity(idInfo.capacity)
+		}
+		room.hostBound = idInfo.hostBound
+
+		// The newest session of an identity takes over its seat, and a
+		// reconnecting client the seat of its ghost if the room is full. The
+		// old session is only let go once the join has passed every check.
+		taken, limit := room.seatsTaken(reconnectCID), room.participantCap(hostHolder)
+		if externalCID != "" {
+			replaced = room.memberWithCID(externalCID)
+		} else if reconnectCID != "" && role == roleParticipant && taken >= limit {
+			replaced = room.participantWithCID(reconnectCID)
+		}
+		if replaced == c {
+			// Still there as a parked membership of a multi-room client
+			room.abandonJoin(emptySince)
+			c.sendError(rid, ErrBadRequest, "Identity is already in this room")
+			return false
+		}
+		if _, ok := room.Participants[replaced]; ok {
+			taken--
+		}
+		if role == roleParticipant && taken >= limit {
+			// Only counts and the host are disclosed to the rejected client
+			details := map[string]interface{}{
+				"participantCount": len(room.Participants),
+				"hostCid":          room.HostCID,
+			}
+			room.abandonJoin(emptySince)
+			log.Printf("[JOIN] Room %s is full", rid)
+			c.sendErrorDetails(rid, ErrRoomFull, "Room is full", details)
+			return false
+		}
+
+		displayName = sanitizeText(joinPayload.DisplayName, maxDisplayNameLength)
+		if displayName != "" && h.nicknamePolicy != nicknamePolicyOff && room.displayNameTaken(displayName, reconnectCID) {
+			if h.nicknamePolicy == nicknamePolicyReject {
+				room.abandonJoin(emptySince)
+				c.sendError(rid, ErrNameTaken, "Display name is already in use in this room")
+				return false
+			}
+			displayName = room.uniqueDisplayName(displayName, reconnectCID)
+		}
+
+		// Taking ownership of one more room is what the per-host cap limits
+		if h.maxRoomsPerHost > 0 && ownedRooms >= h.maxRoomsPerHost && room.HostIdentity == "" && (room.HostCID == "" || hostHolder) {
+			room.abandonJoin(emptySince)
+			log.Printf("[JOIN] Client %s (req %s) rejected from room %s: %s already owns %d rooms", c.sid, c.reqID, rid, identity, ownedRooms)
+			c.sendError(rid, ErrRoomQuotaExceeded, "Too many rooms open as host, try again later")
+			return false
+		}
+
+		keepHost := false
+		if replaced != nil {
+			log.Printf("[JOIN] CID %s is already in room %s. Replacing client %s (req %s)", reconnectCID, rid, replaced.sid, replaced.reqID)
+			keepHost = room.removeMember(replaced, reconnectCID) && externalCID != "" && role == roleParticipant
+		}
+
+		cid = generateID("C-")
+		if externalCID != "" {
+			cid = externalCID
+		}
+		// A member of a room restored after a restart gets its seat back
+		if resumeRole, ok := room.resumable[reconnectCID]; ok && resumeRole == role {
+			cid = reconnectCID
+			delete(room.resumable, cid)
+			if cid == room.resumeHost {
+				room.HostCID = cid
+				room.resumeHost = ""
+			}
+			log.Printf("[JOIN] Client %s (req %s) resumed CID %s in restored room %s", c.sid, c.reqID, cid, rid)
+		}
+		c.roomsMu.Lock()
+		c.cid = cid
+		c.rid = rid
+		c.roomsMu.Unlock()
+		room.emptySince = time.Time{}
+		if role == roleObserver {
+			room.Observers[c] = cid
+		} else {
+			room.Participants[c] = cid
+		}
+		room.LastActivity = time.Now()
+
+		joinedAt = room.LastActivity.UnixMilli()
+		room.JoinedAt[c] = joinedAt
+		if displayName != "" {
+			room.DisplayNames[c] = displayName
+		}
+		c.joins.Add(1)
+
+		if role == roleParticipant && hostHolder {
+			room.hostHolder = c
+		}
+		// Observers never become host. The first host with an identity owns the
+		// room, and gets host back whenever it (re)joins; the host token holder
+		// owns a host-bound room even if an invitee got there first.
+		if role == roleParticipant && identity != "" {
+			if room.HostIdentity == "" && (room.HostCID == "" || hostHolder) {
+				room.HostIdentity = identity
+			}
+			if identity == room.HostIdentity && room.HostCID != cid {
+				log.Printf("[JOIN] Client %s (req %s) reclaims host of room %s (was %q)", c.sid, c.reqID, rid, room.HostCID)
+				room.HostCID = cid
+			}
+		}
+		if keepHost || (room.HostCID == "" && role == roleParticipant) {
+			room.HostCID = cid
+		}
+		hostCid = room.HostCID
+
+		log.Printf("[JOIN] Client %s (req %s) assigned CID %s (%s) in room %s. Host: %s", c.sid, c.reqID, cid, role, rid, hostCid)
+
+		// For the joined reply
+		participants = room.participantList()
+		observers = room.observerList()
+		initiatorCid = room.initiatorCID()
+		label = room.Label
+		capacity = room.Capacity
+		return true
+	}()
+	if !admitted {
+		return
+	}
+	if replaced != nil {
+		h.announceReplaced(room, replaced, c, reconnectCID)
+	}
+
+	payload := map[string]interface{}{
+		"hostCid":      hostCid,
+		"participants": participants,
+		"observers":    observers,
+		"initiatorCid": initiatorCid,
+		"capacity":     capacity,
+		"count":        len(participants),
+	}
+	if label != "" {
+		payload["label"] = label
+	}
+
+	// Include TURN token in joined response (gated by valid room ID)
+	token, expiresAt, err := issueTurnToken(5*time.Minute, turnTokenKindCall)
+	if err != nil {
+		log.Printf("[TURN] Failed to issue token: %v", err)
+	} else {
+		payload["turnToken"] = token
+		payload["turnTokenExpiresAt"] = expiresAt.Unix()
+	}
+
+	resumeToken, resumeExpiresAt, err := issueResumeToken(c.sid, cid, rid, h.resumeTokenTTL())
+	if err != nil {
+		log.Printf("[JOIN] Failed to issue resume token: %v", err)
+	} else {
+		payload["resumeToken"] = resumeToken
+		payload["resumeTokenExpiresAt"] = resumeExpiresAt.Unix()
+	}
+
+	payloadBytes, _ := json.Marshal(payload)
+
+	c.sendMessage(Message{
+		V:       1,
+		Type:    "joined",
+		RID:     rid,
+		SID:     c.sid,
+		CID:     cid,
+		Payload: payloadBytes,
+	})
+
+	if !c.selftest {
+		h.events.emit(RoomEvent{Type: roomEventJoin, RID: rid, CID: cid, Role: role})
+	}
+
+	// Tell the others who arrived, then broadcast the full snapshot
+	joined := Participant{CID: cid, JoinedAt: joinedAt, DisplayName: displayName}
+	if role == roleObserver {
+		joined.Role = roleObserver
+	}
+	joinedPayload, _ := json.Marshal(joined)
+	h.broadcastToRoom(room, Message{
+		V:       1,
+		Type:    "participant_joined",
+		RID:     rid,
+		Payload: joinedPayload,
+	}, c)
+
+	// Broadcast room_state to others
+	h.broadcastRoomState(room, nil)
+
+	// Notify watchers
+	h.broadcastRoomStatusUpdate(rid)
+}
+
+func (h *Hub) handleLeave(c *Client, msg Message) {
+	if c.rid == "" {
+		return
+	}
+	// Acknowledge first, so the leaver can close once it sees left,
+	// knowing the leave went through
+	c.sendMessage(Message{V: 1, Type: "left", RID: c.rid})
+	h.removeClientFromRoom(c, leaveReasonLeft)
+	c.nextRoom()
+}
+
+func (h *Hub) handleEndRoom(c *Client, msg Message) {
+	rid := c.rid
+	if rid == "" {
+		return
+	}
+
+	room, exists := h.rooms.get(rid)
+	if !exists {
+		log.Printf("[END_ROOM] Client %s (req %s) tried to end non-existent room %s", c.sid, c.reqID, rid)
+		return
+	}
+
+	hostCID := func() string {
+		room.mu.Lock()
+		defer room.mu.Unlock()
+		return room.HostCID
+	}()
+
+	if hostCID != c.cid {
+		c.sendError(rid, ErrNotHost, "Only host can end room")
+		log.Printf("[END_ROOM] Client %s (req %s, CID: %s) tried to end room %s but is not host (Host: %s)", c.sid, c.reqID, c.cid, rid, hostCID)
+		return
+	}
+
+	log.Printf("[END_ROOM] Host %s (req %s) ending room %s", c.cid, c.reqID, rid)
+	h.endRoom(room, c.cid, leaveReasonHostEnded)
+}
+
+// members returns every participant and observer in r.
+func (r *Room) members() []*Client {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	clients := make([]*Client, 0, len(r.Participants)+len(r.Observers))
+	for client := range r.Participants {
+		clients = append(clients, client)
+	}
+	for client := range r.Observers {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// clear drops everything r holds once it's been ended, to help GC.
+func (r *Room) clear() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Participants = make(map[*Client]string)
+	r.Observers = make(map[*Client]string)
+	r.JoinedAt = make(map[*Client]int64)
+	r.DisplayNames = make(map[*Client]string)
+	r.ConnStates = make(map[*Client]string)
+	r.HostCID = ""
+	r.HostIdentity = ""
+	r.hostHolder = nil
+	r.pendingOffers = nil
+	r.Label = ""
+	r.dataBytes = 0
+	r.resumable = nil
+	r.resumeHost = ""
+}
+
+// endRoom notifies everyone in room with room_ended and deletes it.
+// by is the ending host's CID, or "admin". Must be called without room lock.
+func (h *Hub) endRoom(room *Room, by, reason string) {
+	rid := room.RID
+
+	// Collect clients to notify
+	clients := room.members()
+
+	log.Printf("[END_ROOM] Ending room %s (by %s, %s). Notifying %d clients", rid, by, reason, len(clients))
+	h.events.emit(RoomEvent{Type: roomEventRoomEnded, RID: rid, CID: by, Reason: reason})
+
+	// Broadcast room_ended
+	endPayload, _ := json.Marshal(map[string]string{
+		"by":     by,
+		"reason": reason,
+	})
+	endMsg := Message{
+		V:       1,
+		Type:    "room_ended",
+		RID:     rid,
+		Payload: endPayload,
+	}
+
+	for _, client := range clients {
+		client.sendMessage(endMsg)
+		// Multi-room clients stay connected for their other rooms
+		if !client.forgetRoom(rid) {
+			client.closeUnlessRejoined(roomEndedGrace)
+		}
+		// Reset client state
+		// Note: modifying client struct is dangerous if read concurrently.
+		// Client struct fields `rid`/`cid` are read in readPump/handle handlers.
+		// Ideally we should protect client fields or just rely on them sending new join.
+		// For MVP, not clearing them is safeish if we assume they will be overwritten on next join.
+		// Or we can clear them but we need a lock on client? Client has no lock.
+		// Let's just leave them stale, it's fine.
+	}
+
+	// Clear room
+	// Re-acquire lock to clear participants? Or just delete room.
+	// If we delete room from hub, existing clients can't find it.
+
+	// Remove room from hub
+	h.rooms.delete(rid, room)
+
+	// Also clear participants in room to help GC
+	room.clear()
+	// Notify watchers
+	h.broadcastRoomStatusUpdate(rid)
+}
+
+func (h *Hub) handleRelay(c *Client, msg Message) {
+	recvTs := time.Now().UnixMilli()
+	if c.rid == "" {
+		log.Printf("[RELAY] Client %s (req %s, CID: %s) tried to relay but not in a room", c.sid, c.reqID, c.cid)
+		return
+	}
+
+	if c.relayLimiter == nil {
+		c.relayLimiter = NewSimpleTokenBucket(h.relayBurst, h.relayRate)
+	}
+	if !c.relayLimiter.Allow() {
+		if time.Since(c.relayLimitedSent) >= relayLimitedErrorInterval {
+			c.relayLimitedSent = time.Now()
+			log.Printf("[RELAY] Client %s (req %s, CID: %s) exceeded the relay rate in room %s", c.sid, c.reqID, c.cid, c.rid)
+			c.sendError(c.rid, ErrRelayRateLimited, "Relay rate exceeded, messages are being dropped")
+		}
+		return
+	}
+
+	room, exists := h.rooms.get(c.rid)
+	if !exists {
+		log.Printf("[RELAY] Client %s (req %s, CID: %s) tried to relay in non-existent room %s", c.sid, c.reqID, c.cid, c.rid)
+		c.sendError(c.rid, ErrRoomClosed, "Room no longer exists")
+		return
+	}
+
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	// The room may have been deleted between the lookup and the lock
+	if room.closed {
+		log.Printf("[RELAY] Client %s (req %s, CID: %s) tried to relay in room %s as it closed", c.sid, c.reqID, c.cid, c.rid)
+		c.sendError(c.rid, ErrRoomClosed, "Room no longer exists")
+		return
+	}
+
+	// Observers are read-only
+	if _, ok := room.Observers[c]; ok {
+		c.sendError(c.rid, ErrObserverReadonly, "Observers cannot send signaling messages")
+		return
+	}
+
+	// Check if sender is in room
+	if _, ok := room.Participants[c]; !ok {
+		log.Printf("[RELAY] Client %s (req %s, CID: %s) tried to relay in room %s but is not a participant", c.sid, c.reqID, c.cid, c.rid)
+		return
+	}
+	if msg.To != "" && msg.To == c.cid {
+		c.sendError(c.rid, ErrCannotRelayToSelf, "Cannot relay a message to yourself")
+		return
+	}
+	if msg.Type == "sealed" && !validSealedPayload(msg.Payload) {
+		c.sendError(c.rid, ErrBadRequest, "Sealed payload must be a base64 string")
+		return
+	}
+	if !room.trackNegotiation(c, msg) {
+		log.Printf("[RELAY] Client %s (req %s, CID: %s) sent an answer with no offer pending in room %s", c.sid, c.reqID, c.cid, c.rid)
+		c.sendError(c.rid, ErrBadNegotiationState, "No offer is waiting for this answer")
+		return
+	}
+	room.LastActivity = time.Now()
+
+	// Relay to other participant(s). Protocol says "to" is optional or required.
+	// MVP: Relay to all OTHER participants.
+
+	// We need to wrap payload with "from"
+	// But Message.Payload is RawMessage.
+	// The protocol says: Server -> client (relay): { payload: { from: "...", ...original_payload... } }
+	// This implies we need to unmarshal payload, add from, and marshal back.
+	// Or more simply: construct a new map.
+
+	// Every relay gets the next room sequence number so clients can spot gaps
+	room.relaySeq++
+
+	// ICE candidates are most of the relay traffic and only need "from", so
+	// it is spliced in directly when the payload allows it
+	var newPayload []byte
+	spliced := false
+	from := ""
+	switch msg.Type {
+	case "ice":
+		newPayload, spliced = spliceFrom(msg.Payload, c.cid)
+	case "sealed":
+		// Never opened; the sender goes in the envelope instead
+		newPayload, spliced = msg.Payload, true
+		from = c.cid
+	}
+
+	if !spliced {
+		var rawPayload map[string]interface{}
+		if err := json.Unmarshal(msg.Payload, &rawPayload); err != nil {
+			rawPayload = make(map[string]interface{})
+			log.Printf("[RELAY] Client %s (req %s, CID: %s) sent invalid payload for type %s: %v", c.sid, c.reqID, c.cid, msg.Type, err)
+		}
+		rawPayload["from"] = c.cid
+
+		// Glare tiebreak: when both peers offer at once, clients compare the
+		// server-assigned seq (and the sender's join time) to pick the polite peer.
+		if msg.Type == "offer" {
+			rawPayload["seq"] = room.relaySeq
+			rawPayload["joinedAt"] = room.JoinedAt[c]
+		}
+
+		// Latency probes: a payload carrying clientTs is relayed with the server's
+		// receive and send times added. Other payloads are left as they are.
+		if _, ok := rawPayload["clientTs"]; ok {
+			rawPayload["recvTs"] = recvTs
+			rawPayload["sendTs"] = time.Now().UnixMilli()
+		}
+
+		newPayload, _ = json.Marshal(rawPayload)
+	}
+
+	relayMsg := Message{
+		V:       1,
+		Type:    msg.Type,
+		RID:     msg.RID,
+		Seq:     room.relaySeq,
+		From:    from,
+		Payload: newPayload,
+	}
+
+	targets := room.relayTargets(c, msg.To)
+	for _, client := range targets {
+		client.sendMessage(relayMsg)
+	}
+	log.Printf("[RELAY] Client %s (req %s, CID: %s) relayed %s message to %d participants in room %s", c.sid, c.reqID, c.cid, msg.Type, len(targets), c.rid)
+	if !c.selftest {
+		h.events.emit(RoomEvent{Type: msg.Type, RID: c.rid, CID: c.cid, To: msg.To})
+	}
+}
+
+// trackNegotiation follows offer/answer order between each pair of
+// participants and reports whether msg fits it. An offer is always accepted
+// (first offer, renegotiation or glare) and leaves its targets expected to
+// answer. An answer is only accepted from a participant with an offer
+// pending from its target, or from anyone when it has no "to". ICE and
+// renegotiate requests are not tracked. Caller must hold room.mu.
+func (r *Room) trackNegotiation(c *Client, msg Message) bool {
+	switch msg.Type {
+	case "offer":
+		if r.pendingOffers == nil {
+			r.pendingOffers = make(map[[2]string]bool)
+		}
+		for client, cid := range r.Participants {
+			if client != c && (msg.To == "" || msg.To == cid) {
+				r.pendingOffers[[2]string{c.cid, cid}] = true
+			}
+		}
+	case "answer":
+		answered := false
+		for pair := range r.pendingOffers {
+			if pair[1] == c.cid && (msg.To == "" || msg.To == pair[0]) {
+				delete(r.pendingOffers, pair)
+				answered = true
+			}
+		}
+		return answered
+	}
+	return true
+}
+
+// relayTargets returns who a relay from c reaches: every other participant,
+// or only the member named by to. Observers only receive relays addressed
+// to them directly. Caller must hold room.mu.
+func (r *Room) relayTargets(c *Client, to string) []*Client {
+	var targets []*Client
+	for client, cid := range r.Participants {
+		if client != c && (to == "" || to == cid) {
+			targets = append(targets, client)
+		}
+	}
+	if to != "" {
+		for client, cid := range r.Observers {
+			if cid == to {
+				targets = append(targets, client)
+			}
+		}
+	}
+	return targets
+}
+
+// Media connection states a participant can report with conn_state
+const (
+	connStateConnecting = "connecting"
+	connStateConnected  = "connected"
+	connStateFailed     = "failed"
+)
+
+// handleConnState records the media connection state a participant reports
+// and relays it to the rest of the room. The server can't verify it; it's
+// kept so room_state can tell a late joiner whether a media session is
+// already up. Reports share the relay budget, and repeats are not relayed.
+func (h *Hub) handleConnState(c *Client, msg Message) {
+	var payload struct {
+		State string `json:"state"`
+	}
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		c.sendError(c.rid, ErrBadRequest, "Invalid payload")
+		return
+	}
+	switch payload.State {
+	case connStateConnecting, connStateConnected, connStateFailed:
+	default:
+		c.sendError(c.rid, ErrBadRequest, "Unknown connection state")
+		return
+	}
+	if c.rid == "" {
+		return
+	}
+
+	if c.relayLimiter == nil {
+		c.relayLimiter = NewSimpleTokenBucket(h.relayBurst, h.relayRate)
+	}
+	if !c.relayLimiter.Allow() {
+		return
+	}
+
+	room, exists := h.rooms.get(c.rid)
+	if !exists {
+		return
+	}
+
+	observer, changed := false, false
+	var recipients []*Client
+	func() {
+		room.mu.Lock()
+		defer room.mu.Unlock()
+		if _, observer = room.Observers[c]; observer {
+			return
+		}
+		if _, ok := room.Participants[c]; !ok || room.ConnStates[c] == payload.State {
+			return
+		}
+		room.ConnStates[c] = payload.State
+		changed = true
+		// Only members that negotiated media_state get the relay
+		for client := range room.Participants {
+			if client != c && client.hasCap(capMediaState) {
+				recipients = append(recipients, client)
+			}
+		}
+		for client := range room.Observers {
+			if client.hasCap(capMediaState) {
+				recipients = append(recipients, client)
+			}
+		}
+	}()
+	if observer {
+		c.sendError(c.rid, ErrObserverReadonly, "Observers cannot report connection state")
+		return
+	}
+	if !changed {
+		return
+	}
+
+	relayPayload, _ := json.Marshal(map[string]string{
+		"from":  c.cid,
+		"state": payload.State,
+	})
+	msg = Message{
+		V:       1,
+		Type:    "conn_state",
+		RID:     c.rid,
+		Payload: relayPayload,
+	}
+	for _, client := range recipients {
+		client.sendMessage(msg)
+	}
+}
+
+// handleData relays an application-defined message (reactions, cursor
+// positions, ...) with "from" added and the payload otherwise untouched.
+// Unlike signaling relays it gets no seq, no room event and no per-message
+// log line, and it has its own rate budget.
+func (h *Hub) handleData(c *Client, msg Message) {
+	if c.rid == "" {
+		return
+	}
+
+	if c.dataLimiter == nil {
+		c.dataLimiter = NewSimpleTokenBucket(h.dataBurst, h.dataRate)
+	}
+	if !c.dataLimiter.Allow() {
+		if time.Since(c.relayLimitedSent) >= relayLimitedErrorInterval {
+			c.relayLimitedSent = time.Now()
+			c.sendError(c.rid, ErrRelayRateLimited, "Data rate exceeded, messages are being dropped")
+		}
+		return
+	}
+
+	room, exists := h.rooms.get(c.rid)
+	if !exists {
+		return
+	}
+
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	if _, ok := room.Observers[c]; ok {
+		c.sendError(c.rid, ErrObserverReadonly, "Observers cannot send data messages")
+		return
+	}
+	if _, ok := room.Participants[c]; !ok {
+		return
+	}
+	if msg.To != "" && msg.To == c.cid {
+		c.sendError(c.rid, ErrCannotRelayToSelf, "Cannot relay a message to yourself")
+		return
+	}
+	room.LastActivity = time.Now()
+
+	payload, ok := spliceFrom(msg.Payload, c.cid)
+	if !ok {
+		var rawPayload map[string]interface{}
+		if err := json.Unmarshal(msg.Payload, &rawPayload); err != nil {
+			rawPayload = make(map[string]interface{})
+		}
+		rawPayload["from"] = c.cid
+		payload, _ = json.Marshal(rawPayload)
+	}
+
+	// ROOM_BYTE_QUOTA bounds what a room can push through the server as
+	// bulk data; signaling relays don't count and keep flowing
+	targets := room.relayTargets(c, msg.To)
+	if h.roomByteQuota > 0 {
+		if room.dataBytes >= h.roomByteQuota {
+			if time.Since(c.quotaExceededSent) >= quotaExceededErrorInterval {
+				c.quotaExceededSent = time.Now()
+				log.Printf("[DATA] Room %s is over its data quota, dropping data from %s (req %s)", c.rid, c.cid, c.reqID)
+				c.sendError(c.rid, ErrQuotaExceeded, "Room data quota exceeded, data messages are being dropped")
+			}
+			return
+		}
+		room.dataBytes += int64(len(payload) * len(targets))
+	}
+
+	dataMsg := Message{
+		V:       1,
+		Type:    "data",
+		RID:     c.rid,
+		Payload: payload,
+	}
+	for _, client := range targets {
+		client.sendMessage(dataMsg)
+	}
+}
+
+// spliceFrom returns payload with "from" inserted as its first key, without
+// decoding it. It only handles a JSON object that can't already contain
+// "from" or "clientTs" (checked loosely on the raw bytes, so any \u escape,
+// which could spell either key, counts); for anything else it reports false
+// and the caller builds the payload through a map, which overrides a
+// client-sent "from" and adds latency timestamps.
+func spliceFrom(payload json.RawMessage, from string) ([]byte, bool) {
+	body := bytes.TrimSpace(payload)
+	if len(body) < 2 || body[0] != '{' || !json.Valid(body) {
+		return nil, false
+	}
+	if bytes.Contains(body, []byte(`"from"`)) || bytes.Contains(body, []byte(`"clientTs"`)) || bytes.Contains(body, []byte(`\u`)) {
+		return nil, false
+	}
+	rest := bytes.TrimSpace(body[1:])
+
+	out := make([]byte, 0, len(body)+len(from)+10)
+	out = append(out, `{"from":`...)
+	out = strconv.AppendQuote(out, from) // CIDs are plain ASCII (external ones are checked), so Go and JSON quoting agree
+	if rest[0] != '}' {
+		out = append(out, ',')
+	}
+	return append(out, rest...), true
+}
+
+// allowRoomSwitch records a join into rid and reports whether c is still
+// within its room switch budget. Rejoining the previous room is free.
+// Caller must hold c.msgMu.
+func (h *Hub) allowRoomSwitch(c *Client, rid string) bool {
+	if h.maxRoomSwitches <= 0 || rid == "" || rid == c.lastJoinRID {
+		return true
+	}
+
+	cutoff := time.Now().Add(-h.roomSwitchWindow)
+	recent := c.roomSwitches[:0]
+	for _, at := range c.roomSwitches {
+		if at.After(cutoff) {
+			recent = append(recent, at)
+		}
+	}
+	c.roomSwitches = recent
+
+	if len(c.roomSwitches) >= h.maxRoomSwitches {
+		return false
+	}
+	c.roomSwitches = append(c.roomSwitches, time.Now())
+	c.lastJoinRID = rid
+	return true
+}
+
+// roomCapacity returns the participant cap for a room whose ID embeds the
+// given capacity (0 if none). An embedded capacity can only lower the global cap.
+func (h *Hub) roomCapacity(embedded int) int {
+	if embedded > 0 && embedded < h.maxParticipants {
+		return embedded
+	}
+	return h.maxParticipants
+}
+
+// Identity of whoever presents a host-bound room's host token
+const hostIdentityToken = "host-token"
+
+// roomsOwnedBy counts the live rooms other than except whose owner is
+// identity (see MAX_ROOMS_PER_HOST). Rooms are locked one at a time, so
+// the caller must not hold a room lock.
+func (h *Hub) roomsOwnedBy(identity, except string) int {
+	owned := 0
+	for _, room := range h.rooms.snapshot() {
+		if room.RID == except {
+			continue
+		}
+		if room.ownedBy(identity) {
+			owned++
+		}
+	}
+	return owned
+}
+
+// ownedBy reports whether r is live and its owner is identity.
+func (r *Room) ownedBy(identity string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.HostIdentity == identity && !r.closed
+}
+
+// announceReplaced finishes a join that took over old's seat cid: the room
+// is told old left, just before it hears joiner arrived, and old that it was
+// superseded. Called without room.mu held.
+func (h *Hub) announceReplaced(room *Room, old, joiner *Client, cid string) {
+	old.dropRoom(room.RID)
+	if !old.selftest {
+		h.events.emit(RoomEvent{Type: roomEventLeave, RID: room.RID, CID: cid, Reason: leaveReasonDisconnected})
+	}
+	leftPayload, _ := json.Marshal(&Departure{CID: cid, Reason: leaveReasonDisconnected})
+	h.broadcastToRoom(room, Message{
+		V:       1,
+		Type:    "participant_left",
+		RID:     room.RID,
+		Payload: leftPayload,
+	}, joiner)
+	h.notifyReplaced(old, room.RID)
+}
+
+// participantWithCID returns the participant holding cid, or nil. Caller
+// must hold r.mu.
+func (r *Room) participantWithCID(cid string) *Client {
+	for client, held := range r.Participants {
+		if held == cid {
+			return client
+		}
+	}
+	return nil
+}
+
+// notifyReplaced tells a client evicted by a reconnecting session that it
+// was superseded, so a stale tab stops trying, and closes it unless it's
+// still in other rooms (multi-room). The eviction is only by cid, so the
+// ghost may well still be connected.
+func (h *Hub) notifyReplaced(ghost *Client, rid string) {
+	ghost.sendMessage(Message{V: 1, Type: "session_replaced", RID: rid})
+	if !ghost.forgetRoom(rid) {
+		// Give the message a moment to go out first
+		time.AfterFunc(replacedCloseDelay, func() {
+			ghost.closeWith(closeCodeReplaced, "SESSION_REPLACED")
+		})
+	}
+}
+
+// seatsTaken counts the participants plus the participant seats held for
+// members that may still resume, other than the one reclaiming is about
+// to take back. Held seats are released once no resume token can claim
+// them. Caller must hold r.mu.
+func (r *Room) seatsTaken(reclaiming string) int {
+	if len(r.resumable) > 0 && time.Now().After(r.resumeUntil) {
+		r.resumable = nil
+		r.resumeHost = ""
+	}
+	taken := len(r.Participants)
+	for cid, role := range r.resumable {
+		if role == roleParticipant && cid != reclaiming {
+			taken++
+		}
+	}
+	return taken
+}
+
+// abandonJoin puts back the empty-room deadline getOrCreate cancelled, for
+// a join that was then turned away, so rejected attempts can't keep an empty
+// room alive. Caller must hold r.mu.
+func (r *Room) abandonJoin(emptySince time.Time) {
+	if r.emptySince.IsZero() && len(r.Participants) == 0 && len(r.Observers) == 0 {
+		r.emptySince = emptySince
+	}
+}
+
+// participantCap returns the participant limit a joiner is held to. While
+// a host-bound room's host is absent, one seat stays free for them.
+// Caller must hold room.mu.
+func (r *Room) participantCap(hostHolder bool) int {
+	if r.hostBound && r.hostHolder == nil && !hostHolder {
+		return r.Capacity - 1
+	}
+	return r.Capacity
+}
+
+// handlePromote lets the host turn an observer into a full participant,
+// subject to the room's participant cap.
+func (h *Hub) handlePromote(c *Client, msg Message) {
+	var payload struct {
+		CID string `json:"cid"`
+	}
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil || payload.CID == "" {
+		c.sendError(c.rid, ErrBadRequest, "Invalid payload")
+		return
+	}
+
+	room, exists := h.rooms.get(c.rid)
+	if !exists {
+		return
+	}
+
+	if code, message := room.promote(c.cid, payload.CID); code != "" {
+		c.sendError(c.rid, code, message)
+		return
+	}
+	rid := room.RID
+
+	log.Printf("[PROMOTE] Host %s (req %s) promoted observer %s in room %s", c.cid, c.reqID, payload.CID, rid)
+
+	h.broadcastRoomState(room, nil)
+	h.broadcastRoomStatusUpdate(rid)
+}
+
+// promote makes observer cid a participant on behalf of hostCID. It
+// returns the error to send the host if it can't.
+func (r *Room) promote(hostCID, cid string) (ErrorCode, string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.HostCID == "" || r.HostCID != hostCID {
+		return ErrNotHost, "Only host can promote observers"
+	}
+
+	var target *Client
+	for client, observerCID := range r.Observers {
+		if observerCID == cid {
+			target = client
+			break
+		}
+	}
+	if target == nil {
+		return ErrBadRequest, "No such observer"
+	}
+	if r.seatsTaken("") >= r.participantCap(false) {
+		return ErrRoomFull, "Room is full"
+	}
+
+	delete(r.Observers, target)
+	r.Participants[target] = cid
+	r.LastActivity = time.Now()
+	return "", ""
+}
+
+// Maximum lengths of user-supplied display text, in characters
+const (
+	maxRoomLabelLength    = 64
+	maxAnnouncementLength = 280
+	maxDisplayNameLength  = 40
+)
+
+// sanitizeText strips control characters, collapses whitespace, caps the
+// length and HTML-escapes the result, since clients may render it as markup.
+func sanitizeText(raw string, maxLength int) string {
+	cleaned := strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || unicode.Is(unicode.Cf, r) {
+			return ' '
+		}
+		return r
+	}, raw)
+	runes := []rune(strings.Join(strings.Fields(cleaned), " "))
+	if len(runes) > maxLength {
+		runes = runes[:maxLength]
+	}
+	return html.EscapeString(string(runes))
+}
+
+// Values of NICKNAME_POLICY
+const (
+	nicknamePolicyOff    = "off"    // duplicate display names are allowed
+	nicknamePolicyReject = "reject" // the join fails with NAME_TAKEN
+	nicknamePolicySuffix = "suffix" // the name gets a " (2)", " (3)", ... suffix
+)
+
+func loadNicknamePolicy() string {
+	policy := strings.ToLower(strings.TrimSpace(os.Getenv("NICKNAME_POLICY")))
+	switch policy {
+	case "":
+		return nicknamePolicyOff
+	case nicknamePolicyOff, nicknamePolicyReject, nicknamePolicySuffix:
+		return policy
+	}
+	log.Printf("[CONFIG] Invalid NICKNAME_POLICY=%q, using %s", policy, nicknamePolicyOff)
+	return nicknamePolicyOff
+}
+
+// displayNameTaken reports whether a member other than except (a CID, e.g.
+// the stale connection of a reconnecting client) already uses name,
+// ignoring case. Caller must hold room.mu.
+func (r *Room) displayNameTaken(name, except string) bool {
+	for client, other := range r.DisplayNames {
+		cid, ok := r.Participants[client]
+		if !ok {
+			cid = r.Observers[client]
+		}
+		if cid != except && strings.EqualFold(other, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// uniqueDisplayName returns name with the lowest numeric suffix that no
+// other member uses. name is sanitized (escaped), so the base is cut on the
+// unescaped text to keep the result within maxDisplayNameLength.
+// Caller must hold room.mu.
+func (r *Room) uniqueDisplayName(name, except string) string {
+	base := []rune(html.UnescapeString(name))
+	for n := 2; ; n++ {
+		suffix := " (" + strconv.Itoa(n) + ")"
+		trimmed := base
+		if keep := maxDisplayNameLength - len(suffix); len(trimmed) > keep {
+			trimmed = trimmed[:keep]
+		}
+		candidate := html.EscapeString(strings.TrimRight(string(trimmed), " ")) + suffix
+		if !r.displayNameTaken(candidate, except) {
+			return candidate
+		}
 	}
+}
 
-	cid := generateID("C-")
-	c.cid = cid
-	c.rid = rid
-	room.Participants[c] = cid
-
-	if room.HostCID == "" {
-		room.HostCID = cid
+// handleSetLabel lets the host set the room's display title. An empty
+// label clears it.
+func (h *Hub) handleSetLabel(c *Client, msg Message) {
+	var payload struct {
+		Label *string `json:"label"`
 	}
-
-	log.Printf("[JOIN] Client %s assigned CID %s in room %s. Host: %s", c.sid, cid, rid, room.HostCID)
-
-	// Send 'joined'
-	participants := []Participant{}
-	for _, id := range room.Participants {
-		participants = append(participants, Participant{CID: id, JoinedAt: time.Now().UnixMilli()})
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil || payload.Label == nil {
+		c.sendError(c.rid, ErrBadRequest, "Invalid payload")
+		return
 	}
 
-	room.mu.Unlock() // <--- CRITICAL FIX: Unlock before broadcast/send to avoid deadlock/blocking
-
-	payload := map[string]interface{}{
-		"hostCid":      room.HostCID,
-		"participants": participants,
+	room, exists := h.rooms.get(c.rid)
+	if !exists {
+		return
 	}
 
-	// Include TURN token in joined response (gated by valid room ID)
-	token, expiresAt, err := issueTurnToken(5*time.Minute, turnTokenKindCall)
-	if err != nil {
-		log.Printf("[TURN] Failed to issue token: %v", err)
-	} else {
-		payload["turnToken"] = token
-		payload["turnTokenExpiresAt"] = expiresAt.Unix()
+	isHost := func() bool {
+		room.mu.Lock()
+		defer room.mu.Unlock()
+		if room.HostCID == "" || room.HostCID != c.cid {
+			return false
+		}
+		room.Label = sanitizeText(*payload.Label, maxRoomLabelLength)
+		room.LastActivity = time.Now()
+		return true
+	}()
+	if !isHost {
+		c.sendError(c.rid, ErrNotHost, "Only host can set the room label")
+		return
 	}
 
-	payloadBytes, _ := json.Marshal(payload)
-
-	c.sendMessage(Message{
-		V:       1,
-		Type:    "joined",
-		RID:     rid,
-		SID:     c.sid,
-		CID:     cid,
-		Payload: payloadBytes,
-	})
+	log.Printf("[SET_LABEL] Host %s (req %s) set label for room %s", c.cid, c.reqID, c.rid)
 
-	// Broadcast room_state to others
-	h.broadcastRoomState(room)
+	h.broadcastRoomState(room, nil)
+}
 
-	// Notify watchers
-	h.broadcastRoomStatusUpdate(rid)
+// isHost reports whether cid is r's current host.
+func (r *Room) isHost(cid string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.HostCID != "" && r.HostCID == cid
 }
 
-func (h *Hub) handleLeave(c *Client, msg Message) {
-	if c.rid == "" {
+// handleBroadcast delivers a host announcement to everyone in the room,
+// the host included, regardless of any "to".
+func (h *Hub) handleBroadcast(c *Client, msg Message) {
+	var payload struct {
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		c.sendError(c.rid, ErrBadRequest, "Invalid payload")
 		return
 	}
-	h.removeClientFromRoom(c)
-}
-
-func (h *Hub) handleEndRoom(c *Client, msg Message) {
-	rid := c.rid
-	if rid == "" {
+	text := sanitizeText(payload.Text, maxAnnouncementLength)
+	if text == "" {
+		c.sendError(c.rid, ErrBadRequest, "Missing text")
 		return
 	}
 
-	h.mu.RLock()
-	room, exists := h.rooms[rid]
-	h.mu.RUnlock()
-
+	room, exists := h.rooms.get(c.rid)
 	if !exists {
-		log.Printf("[END_ROOM] Client %s tried to end non-existent room %s", c.sid, rid)
 		return
 	}
 
-	room.mu.Lock()
-
-	if room.HostCID != c.cid {
-		room.mu.Unlock()
-		c.sendError(rid, "NOT_HOST", "Only host can end room")
-		log.Printf("[END_ROOM] Client %s (CID: %s) tried to end room %s but is not host (Host: %s)", c.sid, c.cid, rid, room.HostCID)
+	if !room.isHost(c.cid) {
+		c.sendError(c.rid, ErrNotHost, "Only host can send announcements")
 		return
 	}
 
-	// Collect clients to notify
-	clients := make([]*Client, 0, len(room.Participants))
-	for client := range room.Participants {
-		clients = append(clients, client)
-	}
-
-	room.mu.Unlock() // Unlock before sending
+	log.Printf("[ANNOUNCE] Host %s (req %s) sent an announcement to room %s", c.cid, c.reqID, c.rid)
 
-	log.Printf("[END_ROOM] Host %s ending room %s. Notifying %d clients", c.cid, rid, len(clients))
-
-	// Broadcast room_ended
-	endPayload, _ := json.Marshal(map[string]string{
-		"by":     c.cid,
-		"reason": "host_ended",
+	announcement, _ := json.Marshal(map[string]string{
+		"by":   c.cid,
+		"text": text,
 	})
-	endMsg := Message{
+	h.broadcastToRoom(room, Message{
 		V:       1,
-		Type:    "room_ended",
-		RID:     rid,
-		Payload: endPayload,
-	}
-
-	for _, client := range clients {
-		client.sendMessage(endMsg)
-		// Reset client state
-		// Note: modifying client struct is dangerous if read concurrently.
-		// Client struct fields `rid`/`cid` are read in readPump/handle handlers.
-		// Ideally we should protect client fields or just rely on them sending new join.
-		// For MVP, not clearing them is safeish if we assume they will be overwritten on next join.
-		// Or we can clear them but we need a lock on client? Client has no lock.
-		// Let's just leave them stale, it's fine.
-	}
-
-	// Clear room
-	// Re-acquire lock to clear participants? Or just delete room.
-	// If we delete room from hub, existing clients can't find it.
-
-	// Remove room from hub
-	h.mu.Lock()
-	delete(h.rooms, rid)
-	h.mu.Unlock()
-
-	// Also clear participants in room to help GC?
-	room.mu.Lock()
-	room.Participants = make(map[*Client]string)
-	room.HostCID = ""
-	room.mu.Unlock()
-
-	// Notify watchers
-	h.broadcastRoomStatusUpdate(rid)
+		Type:    "announcement",
+		RID:     c.rid,
+		Payload: announcement,
+	}, nil)
 }
 
-func (h *Hub) handleRelay(c *Client, msg Message) {
-	if c.rid == "" {
-		log.Printf("[RELAY] Client %s (CID: %s) tried to relay but not in a room", c.sid, c.cid)
+// handleRequestMute forwards a host's mute request to one participant.
+// The server can't touch media, so complying is up to the target client.
+func (h *Hub) handleRequestMute(c *Client, msg Message) {
+	if msg.To == "" {
+		c.sendError(c.rid, ErrBadRequest, "Missing target")
 		return
 	}
 
-	h.mu.RLock()
-	room, exists := h.rooms[c.rid]
-	h.mu.RUnlock()
-
+	room, exists := h.rooms.get(c.rid)
 	if !exists {
-		log.Printf("[RELAY] Client %s (CID: %s) tried to relay in non-existent room %s", c.sid, c.cid, c.rid)
 		return
 	}
 
-	room.mu.Lock()
-	defer room.mu.Unlock()
+	target, isHost := func() (*Client, bool) {
+		room.mu.Lock()
+		defer room.mu.Unlock()
+		if room.HostCID == "" || room.HostCID != c.cid {
+			return nil, false
+		}
+		for client, cid := range room.Participants {
+			if cid == msg.To && client != c {
+				return client, true
+			}
+		}
+		return nil, true
+	}()
+	if !isHost {
+		c.sendError(c.rid, ErrNotHost, "Only host can request mute")
+		return
+	}
 
-	// Check if sender is in room
-	if _, ok := room.Participants[c]; !ok {
-		log.Printf("[RELAY] Client %s (CID: %s) tried to relay in room %s but is not a participant", c.sid, c.cid, c.rid)
+	if target == nil {
+		c.sendError(c.rid, ErrBadRequest, "No such participant")
 		return
 	}
 
-	// Relay to other participant(s). Protocol says "to" is optional or required.
-	// MVP: Relay to all OTHER participants.
+	log.Printf("[REQUEST_MUTE] Host %s (req %s) asked %s to mute in room %s", c.cid, c.reqID, msg.To, c.rid)
 
-	// We need to wrap payload with "from"
-	// But Message.Payload is RawMessage.
-	// The protocol says: Server -> client (relay): { payload: { from: "...", ...original_payload... } }
-	// This implies we need to unmarshal payload, add from, and marshal back.
-	// Or more simply: construct a new map.
+	mutePayload, _ := json.Marshal(map[string]string{"by": c.cid})
+	target.sendMessage(Message{
+		V:       1,
+		Type:    "mute_requested",
+		RID:     c.rid,
+		Payload: mutePayload,
+	})
+}
 
-	var rawPayload map[string]interface{}
-	if err := json.Unmarshal(msg.Payload, &rawPayload); err != nil {
-		rawPayload = make(map[string]interface{})
-		log.Printf("[RELAY] Client %s (CID: %s) sent invalid payload for type %s: %v", c.sid, c.cid, msg.Type, err)
+// handlePing answers an app-level ping with a pong to the sender only,
+// echoing its payload, so clients can run a watchdog that also covers the
+// hub's message processing. Pings over the rate are dropped silently.
+func (h *Hub) handlePing(c *Client, msg Message) {
+	if c.pingLimiter == nil {
+		c.pingLimiter = NewSimpleTokenBucket(appPingBurst, appPingRate)
 	}
-	rawPayload["from"] = c.cid
-
-	newPayload, _ := json.Marshal(rawPayload)
-
-	relayMsg := Message{
+	if !c.pingLimiter.Allow() {
+		return
+	}
+	c.sendMessage(Message{
 		V:       1,
-		Type:    msg.Type,
+		Type:    "pong",
 		RID:     msg.RID,
-		Payload: newPayload,
+		Payload: msg.Payload,
+	})
+}
+
+// handleGetState sends c a fresh room_state for its current room, so a
+// client that missed a broadcast can resync without rejoining. Requests
+// over the budget are dropped, like app-level pings.
+func (h *Hub) handleGetState(c *Client, msg Message) {
+	if c.stateLimiter == nil {
+		c.stateLimiter = NewSimpleTokenBucket(getStateBurst, getStateRate)
+	}
+	if !c.stateLimiter.Allow() {
+		return
 	}
 
-	relayedCount := 0
-	for client, cid := range room.Participants {
-		if cid != c.cid {
-			// Check 'to' if present? Protocol says "to" is optional/recommended.
-			// Implementing direct targeting if "to" is present
-			if msg.To != "" && msg.To != cid {
-				continue
-			}
-			client.sendMessage(relayMsg)
-			relayedCount++
-		}
+	rid := msg.RID
+	if rid == "" {
+		rid = c.rid
+	}
+	if rid == "" || rid != c.rid {
+		c.sendError(msg.RID, ErrBadRequest, "Not in this room")
+		return
+	}
+	room, exists := h.rooms.get(rid)
+	if !exists {
+		c.sendError(rid, ErrRoomClosed, "Room no longer exists")
+		return
+	}
+
+	state := h.roomStateMessage(room, nil)
+	if !slices.Contains(state.clients, c) {
+		c.sendError(rid, ErrBadRequest, "Not in this room")
+		return
 	}
-	log.Printf("[RELAY] Client %s (CID: %s) relayed %s message to %d participants in room %s", c.sid, c.cid, msg.Type, relayedCount, c.rid)
+	c.sendMessage(state.messageFor(c))
 }
 
-func (h *Hub) handleDisconnect(c *Client) {
-	log.Printf("[DISCONNECT] Client %s disconnected", c.sid)
+// disconnect runs handleDisconnect once the message c is in the middle of,
+// if any, has been handled: the handlers own c.rid and the rest of c's room
+// state. It must not be called with c.msgMu held.
+func (h *Hub) disconnect(c *Client, reason string) {
+	c.msgMu.Lock()
+	defer c.msgMu.Unlock()
+	h.handleDisconnect(c, reason)
+}
+
+// handleDisconnect releases everything held by c. It is safe to call more
+// than once (e.g. reaper and transport racing); only the first call has effect.
+// Caller must hold c.msgMu (see disconnect).
+func (h *Hub) handleDisconnect(c *Client, reason string) {
+	if !c.disconnected.CompareAndSwap(false, true) {
+		return
+	}
+	log.Printf("[DISCONNECT] Client %s (req %s) disconnected (%s)", c.sid, c.reqID, reason)
+	h.clients.remove(c)
+	h.ipConns.Release(c.ip)
+
 	h.mu.Lock()
-	delete(h.clients, c)
 	// Remove from all watchers
 	for rid, clientSet := range h.watchers {
 		delete(clientSet, c)
@@ -512,104 +2242,342 @@ func (h *Hub) handleDisconnect(c *Client) {
 	}
 	h.mu.Unlock()
 
-	if c.rid != "" {
-		h.removeClientFromRoom(c)
+	// A multi-room client leaves every room it's in
+	for {
+		if c.rid != "" {
+			h.removeClientFromRoom(c, reason)
+		}
+		if !c.nextRoom() {
+			return
+		}
 	}
 }
 
-func (h *Hub) removeClientFromRoom(c *Client) {
-	log.Printf("[REMOVE_FROM_ROOM] Client %s (CID: %s) being removed from room %s", c.sid, c.cid, c.rid)
-	h.mu.Lock()
-	room, exists := h.rooms[c.rid]
-	h.mu.Unlock()
+// removeClientFromRoom takes c out of its current room.
+func (h *Hub) removeClientFromRoom(c *Client, reason string) {
+	h.removeFromRoom(c, c.rid, c.cid, reason)
+}
 
+// removeFromRoom takes c's membership cid out of room rid, which needn't be
+// c's current room for a multi-room client.
+func (h *Hub) removeFromRoom(c *Client, rid, cid, reason string) {
+	log.Printf("[REMOVE_FROM_ROOM] Client %s (req %s, CID: %s) being removed from room %s", c.sid, c.reqID, cid, rid)
+	room, exists := h.rooms.get(rid)
 	if !exists {
-		log.Printf("[REMOVE_FROM_ROOM] Room %s not found for client %s", c.rid, c.sid)
+		log.Printf("[REMOVE_FROM_ROOM] Room %s not found for client %s (req %s)", rid, c.sid, c.reqID)
 		return
 	}
 
-	rid := c.rid // Store RID for broadcast
-	room.mu.Lock()
-	delete(room.Participants, c)
-	log.Printf("[REMOVE_FROM_ROOM] Client %s (CID: %s) removed from room %s. Remaining participants: %d", c.sid, c.cid, c.rid, len(room.Participants))
-
-	// Manage Host
-	if room.HostCID == c.cid {
-		// Transfer host to next available
-		newHost := ""
-		for _, cid := range room.Participants {
-			newHost = cid
-			break // pick any
-		}
-		room.HostCID = newHost
-		if newHost != "" {
-			log.Printf("[REMOVE_FROM_ROOM] Host %s left room %s. New host: %s", c.cid, c.rid, newHost)
-		} else {
-			// No participants left, host is empty
+	var vacant, isEmpty bool
+	func() {
+		room.mu.Lock()
+		defer room.mu.Unlock()
+		role := roleParticipant
+		if _, ok := room.Observers[c]; ok {
+			role = roleObserver
 		}
-	}
+		wasHost := room.removeMember(c, cid)
+		log.Printf("[REMOVE_FROM_ROOM] Client %s (req %s, CID: %s) removed from room %s. Remaining participants: %d", c.sid, c.reqID, cid, rid, len(room.Participants))
+
+		vacant = len(room.Participants) == 0 && len(room.Observers) == 0
+		// A room that just emptied waits out the grace period so a member whose
+		// connection dropped can come back. The last one out keeps its seat (and
+		// host role) for a rejoin with its resume token.
+		if vacant && h.emptyRoomGrace > 0 {
+			room.emptySince = time.Now()
+			if reason == leaveReasonDisconnected || reason == leaveReasonTimeout {
+				if room.resumable == nil {
+					room.resumable = make(map[string]string)
+				}
+				room.resumable[cid] = role
+				room.resumeUntil = time.Now().Add(h.resumeTokenTTL())
+				if wasHost {
+					room.resumeHost = cid
+				}
+			}
+		}
+
+		// Rooms with seats held after a restart stay until the sweep
+		isEmpty = vacant && h.emptyRoomGrace <= 0 && len(room.resumable) == 0
+	}()
 
-	isEmpty := len(room.Participants) == 0
-	room.mu.Unlock()
+	c.dropRoom(rid)
 
-	c.rid = ""
-	c.cid = ""
+	if !c.selftest {
+		h.events.emit(RoomEvent{Type: roomEventLeave, RID: rid, CID: cid, Reason: reason})
+	}
 
 	if isEmpty {
 		log.Printf("[REMOVE_FROM_ROOM] Room %s is now empty. Deleting room.", rid)
-		h.mu.Lock()
-		delete(h.rooms, rid)
-		h.mu.Unlock()
+		h.rooms.delete(rid, room)
+	} else if vacant {
+		log.Printf("[REMOVE_FROM_ROOM] Room %s is now empty. Keeping it for %s", rid, h.emptyRoomGrace)
 	} else {
-		h.broadcastRoomState(room)
+		departure := &Departure{CID: cid, Reason: reason}
+		leftPayload, _ := json.Marshal(departure)
+		// A silent drop is worth telling apart from a clean leave: the
+		// remaining peer may still see the stale media path for a while.
+		if reason == leaveReasonTimeout {
+			h.broadcastToRoom(room, Message{
+				V:       1,
+				Type:    "peer_timeout",
+				RID:     rid,
+				Payload: leftPayload,
+			}, nil)
+		}
+		h.broadcastToRoom(room, Message{
+			V:       1,
+			Type:    "participant_left",
+			RID:     rid,
+			Payload: leftPayload,
+		}, nil)
+		h.broadcastRoomState(room, departure)
 	}
 
 	// Notify watchers
 	h.broadcastRoomStatusUpdate(rid)
 }
 
-func (h *Hub) broadcastRoomState(room *Room) {
+// removeMember takes c, holding cid, out of the room and hands the host
+// role to another participant if it was c's. It reports whether c was the
+// host. Caller must hold r.mu.
+func (r *Room) removeMember(c *Client, cid string) bool {
+	delete(r.Participants, c)
+	delete(r.Observers, c)
+	delete(r.JoinedAt, c)
+	delete(r.DisplayNames, c)
+	delete(r.ConnStates, c)
+	if r.hostHolder == c {
+		r.hostHolder = nil
+	}
+	for pair := range r.pendingOffers {
+		if pair[0] == cid || pair[1] == cid {
+			delete(r.pendingOffers, pair)
+		}
+	}
+	r.LastActivity = time.Now()
+
+	if r.HostCID != cid {
+		return false
+	}
+	// Transfer host to next available
+	newHost := ""
+	var newHostClient *Client
+	for other, otherCID := range r.Participants {
+		newHost, newHostClient = otherCID, other
+		break // pick any
+	}
+	r.HostCID = newHost
+	if newHost != "" {
+		log.Printf("[REMOVE_FROM_ROOM] Host %s (req %s) left room %s. New host: %s (req %s)", cid, c.reqID, r.RID, newHost, newHostClient.reqID)
+	}
+	return true
+}
+
+// observerList returns the room's observers. Caller must hold room.mu.
+func (r *Room) observerList() []Participant {
+	observers := []Participant{}
+	for client, cid := range r.Observers {
+		observers = append(observers, Participant{CID: cid, Role: roleObserver, DisplayName: r.DisplayNames[client]})
+	}
+	return observers
+}
+
+// participantList returns the room's participants ordered by join time,
+// with CID as tiebreak, so every snapshot lists them the same way.
+// Caller must hold room.mu.
+func (r *Room) participantList() []Participant {
+	participants := make([]Participant, 0, len(r.Participants))
+	for client, cid := range r.Participants {
+		participants = append(participants, Participant{CID: cid, JoinedAt: r.JoinedAt[client], DisplayName: r.DisplayNames[client], ConnState: r.ConnStates[client]})
+	}
+	sortParticipants(participants)
+	return participants
+}
+
+// sortParticipants orders participants by join time, then CID.
+func sortParticipants(participants []Participant) {
+	slices.SortFunc(participants, func(a, b Participant) int {
+		if a.JoinedAt != b.JoinedAt {
+			return cmp.Compare(a.JoinedAt, b.JoinedAt)
+		}
+		return strings.Compare(a.CID, b.CID)
+	})
+}
+
+// initiatorCID returns the participant that should create the offer: the
+// earliest joiner, with CID as tiebreak. A reconnecting client gets a new
+// join time, so the peer that stayed becomes the initiator.
+// Caller must hold room.mu.
+func (r *Room) initiatorCID() string {
+	var initiator *Client
+	for client, cid := range r.Participants {
+		if initiator == nil ||
+			r.JoinedAt[client] < r.JoinedAt[initiator] ||
+			(r.JoinedAt[client] == r.JoinedAt[initiator] && cid < r.Participants[initiator]) {
+			initiator = client
+		}
+	}
+	if initiator == nil {
+		return ""
+	}
+	return r.Participants[initiator]
+}
+
+func (h *Hub) broadcastRoomState(room *Room, departed *Departure) {
 	// Must be called without room lock!
+	// departed is set when the broadcast is caused by someone leaving.
+	state := h.roomStateMessage(room, departed)
 
-	room.mu.Lock()
-	participants := []Participant{}
-	for _, cid := range room.Participants {
-		participants = append(participants, Participant{CID: cid})
+	var dropped []*Client
+	for _, client := range state.clients {
+		if !client.sendMessage(state.messageFor(client)) {
+			dropped = append(dropped, client)
+		}
 	}
-	hostCid := room.HostCID
-	rid := room.RID
-	// Collect clients
-	clients := make([]*Client, 0, len(room.Participants))
-	for client := range room.Participants {
-		clients = append(clients, client)
+
+	// room_state is idempotent, and a client that misses one may keep showing
+	// a participant who left. Retry once with a fresh snapshot.
+	if len(dropped) > 0 {
+		time.AfterFunc(roomStateRetryDelay, func() {
+			h.retryRoomState(room, dropped)
+		})
+	}
+}
+
+// retryRoomState re-sends the current room_state to clients that missed
+// one. A client that still can't take it is closed so it reconnects with
+// a fresh view.
+func (h *Hub) retryRoomState(room *Room, clients []*Client) {
+	state := h.roomStateMessage(room, nil)
+	for _, client := range clients {
+		if !slices.Contains(state.clients, client) {
+			continue
+		}
+		if !client.sendMessage(state.messageFor(client)) {
+			log.Printf("[BROADCAST] Client %s (req %s, CID: %s) missed room_state twice. Closing", client.sid, client.reqID, client.cid)
+			client.closeWith(closeCodeSlowConsumer, "SLOW_CONSUMER")
+		}
+	}
+}
+
+// roomState is a room_state snapshot ready to send to clients. The host
+// gets a variant whose participants carry transport and network hints for
+// moderation; everyone else gets the plain list.
+type roomState struct {
+	msg     Message
+	hostMsg Message
+	host    *Client
+	clients []*Client
+}
+
+func (s *roomState) messageFor(c *Client) Message {
+	if c == s.host {
+		return s.hostMsg
 	}
-	room.mu.Unlock()
+	return s.msg
+}
+
+// roomStateMessage builds the room_state messages for room along with the
+// clients they should go to. Must be called without room lock.
+func (h *Hub) roomStateMessage(room *Room, departed *Departure) *roomState {
+	state := &roomState{}
+
+	var participants, detailed, observers []Participant
+	var initiatorCid, hostCid, label, rid string
+	var capacity int
+	func() {
+		room.mu.Lock()
+		defer room.mu.Unlock()
+		participants = []Participant{}
+		detailed = []Participant{}
+		for client, cid := range room.Participants {
+			p := Participant{CID: cid, JoinedAt: room.JoinedAt[client], DisplayName: room.DisplayNames[client], ConnState: room.ConnStates[client]}
+			participants = append(participants, p)
+			p.Transport = client.transport
+			p.Network = coarseNetwork(client.ip)
+			detailed = append(detailed, p)
+			if cid == room.HostCID {
+				state.host = client
+			}
+		}
+		sortParticipants(participants)
+		sortParticipants(detailed)
+		observers = room.observerList()
+		initiatorCid = room.initiatorCID()
+		hostCid = room.HostCID
+		label = room.Label
+		capacity = room.Capacity
+		rid = room.RID
+		// Collect clients
+		state.clients = make([]*Client, 0, len(room.Participants)+len(room.Observers))
+		for client := range room.Participants {
+			state.clients = append(state.clients, client)
+		}
+		for client := range room.Observers {
+			state.clients = append(state.clients, client)
+		}
+	}()
 
 	payload := map[string]interface{}{
 		"hostCid":      hostCid,
 		"participants": participants,
+		"observers":    observers,
+		"initiatorCid": initiatorCid,
+		"capacity":     capacity,
+		"count":        len(participants),
+	}
+	if label != "" {
+		payload["label"] = label
+	}
+	if departed != nil {
+		payload["departed"] = departed
 	}
 	payloadBytes, _ := json.Marshal(payload)
 
+	payload["participants"] = detailed
+	hostPayloadBytes, _ := json.Marshal(payload)
+
 	log.Printf("[BROADCAST] Room State for %s: %d participants", rid, len(participants))
 
-	msg := Message{
+	state.msg = Message{
 		V:       1,
 		Type:    "room_state",
 		RID:     rid,
 		Payload: payloadBytes,
 	}
+	state.hostMsg = state.msg
+	state.hostMsg.Payload = hostPayloadBytes
+	return state
+}
 
-	for _, client := range clients {
-		client.sendMessage(msg)
+// broadcastToRoom sends msg to every participant except the given client.
+// Must be called without room lock!
+func (h *Hub) broadcastToRoom(room *Room, msg Message, except *Client) {
+	for _, client := range room.members() {
+		if client != except {
+			client.sendMessage(msg)
+		}
 	}
 }
 
-func (c *Client) sendError(rid, code, message string) {
-	payload, _ := json.Marshal(map[string]interface{}{
-		"code":    code,
-		"message": message,
-	})
+func (c *Client) sendError(rid string, code ErrorCode, message string) {
+	c.sendErrorDetails(rid, code, message, nil)
+}
+
+// sendErrorDetails sends an error with optional structured data under "details".
+func (c *Client) sendErrorDetails(rid string, code ErrorCode, message string, details interface{}) {
+	info := errorCodes[code]
+	body := map[string]interface{}{
+		"code":      code,
+		"message":   message,
+		"category":  info.category,
+		"retryable": info.retryable,
+	}
+	if details != nil {
+		body["details"] = details
+	}
+	payload, _ := json.Marshal(body)
 	c.sendMessage(Message{
 		V:       1,
 		Type:    "error",
@@ -618,43 +2586,59 @@ func (c *Client) sendError(rid, code, message string) {
 	})
 }
 
+const idRandomBytes = 8
+
 func generateID(prefix string) string {
-	b := make([]byte, 8)
+	b := make([]byte, idRandomBytes)
 	rand.Read(b)
 	return prefix + hex.EncodeToString(b)
 }
 
+// validSID reports whether sid looks like one generateID("S-") made, so
+// client-supplied session IDs can be rejected before any lookup.
+func validSID(sid string) bool {
+	if len(sid) != len("S-")+2*idRandomBytes || !strings.HasPrefix(sid, "S-") {
+		return false
+	}
+	for _, r := range sid[2:] {
+		if !('0' <= r && r <= '9' || 'a' <= r && r <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
 func (h *Hub) handleWatchRooms(c *Client, msg Message) {
 	var payload struct {
 		RIDs []string `json:"rids"`
 	}
 	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
-		c.sendError(msg.RID, "BAD_REQUEST", "Invalid payload")
+		c.sendError(msg.RID, ErrBadRequest, "Invalid payload")
 		return
 	}
 
-	h.mu.Lock()
 	status := make(map[string]int)
-	for _, rid := range payload.RIDs {
-		if err := validateRoomID(rid); err != nil {
-			continue
-		}
-		// Add to watchers
-		if h.watchers[rid] == nil {
-			h.watchers[rid] = make(map[*Client]bool)
-		}
-		h.watchers[rid][c] = true
+	func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		for _, rid := range payload.RIDs {
+			if err := validateRoomID(rid); err != nil {
+				continue
+			}
+			// Add to watchers
+			if h.watchers[rid] == nil {
+				h.watchers[rid] = make(map[*Client]bool)
+			}
+			h.watchers[rid][c] = true
 
-		// Get current count
-		if room, ok := h.rooms[rid]; ok {
-			room.mu.Lock()
-			status[rid] = len(room.Participants)
-			room.mu.Unlock()
-		} else {
-			status[rid] = 0
+			// Get current count
+			if room, ok := h.rooms.get(rid); ok {
+				status[rid] = room.participantCount()
+			} else {
+				status[rid] = 0
+			}
 		}
-	}
-	h.mu.Unlock()
+	}()
 
 	statusBytes, _ := json.Marshal(status)
 	c.sendMessage(Message{
@@ -664,22 +2648,26 @@ func (h *Hub) handleWatchRooms(c *Client, msg Message) {
 	})
 }
 
+// participantCount returns how many participants r has.
+func (r *Room) participantCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.Participants)
+}
+
 func (h *Hub) broadcastRoomStatusUpdate(rid string) {
 	h.mu.RLock()
 	clients, exists := h.watchers[rid]
+	h.mu.RUnlock()
 	if !exists {
-		h.mu.RUnlock()
 		return
 	}
 
 	// Get current count
 	count := 0
-	if room, ok := h.rooms[rid]; ok {
-		room.mu.Lock()
-		count = len(room.Participants)
-		room.mu.Unlock()
+	if room, ok := h.rooms.get(rid); ok {
+		count = room.participantCount()
 	}
-	h.mu.RUnlock()
 
 	payload, _ := json.Marshal(map[string]interface{}{
 		"rid":   rid,
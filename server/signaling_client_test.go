@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"serenada/server/client"
+	"serenada/server/protocol"
+)
+
+// A pending request is only answered by the errors that request can get.
+// An unrelated one, like RELAY_RATE_LIMITED for an earlier relay in the
+// same room, leaves it waiting for its reply.
+func TestClientRequestIgnoresUnrelatedErrors(t *testing.T) {
+	rid := newTestRoomID(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Upgrade(w, r, nil, 1024, 1024)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var join protocol.Message
+		if err := conn.ReadJSON(&join); err != nil {
+			return
+		}
+		conn.WriteJSON(protocol.Message{V: 1, Type: protocol.TypeError, RID: rid,
+			Payload: []byte(`{"code":"RELAY_RATE_LIMITED","message":"Relay rate exceeded"}`)})
+		conn.WriteJSON(protocol.Message{V: 1, Type: protocol.TypeJoined, RID: rid, CID: "C-1",
+			Payload: []byte(`{"hostCid":"C-1","participants":[]}`)})
+		conn.ReadMessage()
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := client.Dial(ctx, "ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Join(ctx, rid, protocol.JoinRequest{}); err != nil {
+		t.Fatalf("join ended by an unrelated error: %v", err)
+	}
+}
+
+// A rejection the request can get is returned as a *protocol.Error.
+func TestClientJoinRejected(t *testing.T) {
+	h := newTestHub(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWs(h, w, r)
+	}))
+	defer srv.Close()
+	rid := newTestRoomID(t)
+	joinTestRoom(t, h, newTestClient(h), rid)
+	joinTestRoom(t, h, newTestClient(h), rid)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := client.Dial(ctx, "ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	_, err = c.Join(ctx, rid, protocol.JoinRequest{})
+	var rejected *protocol.Error
+	if !errors.As(err, &rejected) || rejected.Code != protocol.CodeRoomFull {
+		t.Fatalf("join of a full room: got %v, want %s", err, protocol.CodeRoomFull)
+	}
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"html"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// The earliest joiner initiates. A participant that drops and rejoins
+// gets a new join time, so the one that stayed takes over.
+func TestInitiatorFollowsJoinOrderAcrossReconnects(t *testing.T) {
+	h := newTestHub(t)
+	rid := newTestRoomID(t)
+
+	a := newTestClient(h)
+	joined := joinTestRoom(t, h, a, rid)
+	if joined["initiatorCid"] != a.cid {
+		t.Fatalf("alone in the room: initiatorCid = %v, want %s", joined["initiatorCid"], a.cid)
+	}
+
+	// Join times are in milliseconds; keep them distinct
+	time.Sleep(2 * time.Millisecond)
+	b := newTestClient(h)
+	joined = joinTestRoom(t, h, b, rid)
+	if joined["initiatorCid"] != a.cid {
+		t.Fatalf("second joiner: initiatorCid = %v, want first joiner %s", joined["initiatorCid"], a.cid)
+	}
+	if got := initiatorIn(t, nextOfType(t, a, "room_state")); got != a.cid {
+		t.Fatalf("room_state after second join: initiatorCid = %s, want %s", got, a.cid)
+	}
+
+	// a drops and comes back on a new connection
+	drain(b)
+	h.disconnect(a, leaveReasonDisconnected)
+	if got := initiatorIn(t, nextOfType(t, b, "room_state")); got != b.cid {
+		t.Fatalf("room_state after a left: initiatorCid = %s, want %s", got, b.cid)
+	}
+	time.Sleep(2 * time.Millisecond)
+	drain(b)
+	a2 := newTestClient(h)
+	joined = joinTestRoom(t, h, a2, rid)
+	if joined["initiatorCid"] != b.cid {
+		t.Fatalf("rejoiner: initiatorCid = %v, want %s who stayed", joined["initiatorCid"], b.cid)
+	}
+	if got := initiatorIn(t, nextOfType(t, b, "room_state")); got != b.cid {
+		t.Fatalf("room_state after rejoin: initiatorCid = %s, want %s", got, b.cid)
+	}
+
+	// and again the other way round
+	h.disconnect(b, leaveReasonDisconnected)
+	time.Sleep(2 * time.Millisecond)
+	b2 := newTestClient(h)
+	joined = joinTestRoom(t, h, b2, rid)
+	if joined["initiatorCid"] != a2.cid {
+		t.Fatalf("second rejoiner: initiatorCid = %v, want %s", joined["initiatorCid"], a2.cid)
+	}
+}
+
+func initiatorIn(t *testing.T, msg Message) string {
+	t.Helper()
+	var payload struct {
+		InitiatorCID string `json:"initiatorCid"`
+	}
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		t.Fatal(err)
+	}
+	return payload.InitiatorCID
+}
+
+// The read loop and an eviction can both disconnect the same client. Only
+// one of them may take it out of its room and release its connection slot.
+// Run with -race.
+func TestConcurrentDisconnectAndEviction(t *testing.T) {
+	h := newTestHub(t)
+	// Hold a slot of our own, so releasing the client's twice shows up
+	ipKey := rateLimitKey("127.0.0.1")
+	h.ipConns.Acquire(ipKey)
+
+	for i := 0; i < 20; i++ {
+		rid := newTestRoomID(t)
+		peer := newTestClient(h)
+		joinTestRoom(t, h, peer, rid)
+
+		conn, c := dialTestWS(t, h)
+		if err := conn.WriteJSON(Message{V: 1, Type: "join", RID: rid}); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			var msg Message
+			if err := conn.ReadJSON(&msg); err != nil {
+				t.Fatal(err)
+			}
+			if msg.Type == "joined" {
+				break
+			}
+		}
+		drain(peer)
+
+		var wg sync.WaitGroup
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			conn.Close()
+		}()
+		go func() {
+			defer wg.Done()
+			h.disconnect(c, leaveReasonTimeout)
+		}()
+		go func() {
+			defer wg.Done()
+			h.disconnect(c, leaveReasonDisconnected)
+		}()
+		wg.Wait()
+
+		left := 0
+		for {
+			select {
+			case out := <-peer.send:
+				var msg Message
+				json.Unmarshal(out.data, &msg)
+				if msg.Type == "participant_left" {
+					left++
+				}
+				continue
+			default:
+			}
+			break
+		}
+		if left != 1 {
+			t.Fatalf("peer got %d participant_left messages, want 1", left)
+		}
+		if _, ok := h.clients.get(c.sid); ok {
+			t.Fatalf("client %s still registered", c.sid)
+		}
+		h.disconnect(peer, leaveReasonLeft)
+	}
+
+	h.ipConns.mu.Lock()
+	defer h.ipConns.mu.Unlock()
+	if n := h.ipConns.counts[ipKey]; n != 1 {
+		t.Fatalf("%d connection slots held for %s after every client disconnected, want 1", n, ipKey)
+	}
+}
+
+// A session that rejoins a full room on a second stream, with the resume
+// token the first stream got, takes over the seat the first still holds.
+// The first stream is told session_replaced and closed with 4009, and its
+// teardown doesn't announce the departure a second time.
+func TestResumeFromSecondStreamReplacesFirst(t *testing.T) {
+	h := newTestHub(t)
+	rid := newTestRoomID(t)
+
+	readUntil := func(conn *websocket.Conn, msgType string) Message {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			var msg Message
+			if err := conn.ReadJSON(&msg); err != nil {
+				t.Fatalf("waiting for %s: %v", msgType, err)
+			}
+			if msg.Type == msgType {
+				return msg
+			}
+		}
+	}
+
+	first, stale := dialTestWS(t, h)
+	if err := first.WriteJSON(Message{V: 1, Type: "join", RID: rid}); err != nil {
+		t.Fatal(err)
+	}
+	var joined struct {
+		CID         string `json:"cid"`
+		ResumeToken string `json:"resumeToken"`
+	}
+	if err := json.Unmarshal(readUntil(first, "joined").Payload, &joined); err != nil {
+		t.Fatal(err)
+	}
+	peer := newTestClient(h)
+	joinTestRoom(t, h, peer, rid)
+	drain(peer)
+
+	second, _ := dialTestWS(t, h)
+	rejoin, _ := json.Marshal(map[string]string{"resumeToken": joined.ResumeToken})
+	if err := second.WriteJSON(Message{V: 1, Type: "join", RID: rid, Payload: rejoin}); err != nil {
+		t.Fatal(err)
+	}
+	readUntil(second, "joined")
+
+	if msg := readUntil(first, "session_replaced"); msg.RID != rid {
+		t.Errorf("session_replaced for room %q, want %q", msg.RID, rid)
+	}
+	var msg Message
+	if err := first.ReadJSON(&msg); !websocket.IsCloseError(err, closeCodeReplaced) {
+		t.Fatalf("replaced stream: got %v, want close %d", err, closeCodeReplaced)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !stale.disconnected.Load() {
+		if time.Now().After(deadline) {
+			t.Fatal("replaced client never disconnected")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	stale.msgMu.Lock()
+	stale.msgMu.Unlock()
+
+	left := 0
+	for {
+		select {
+		case out := <-peer.send:
+			var msg Message
+			json.Unmarshal(out.data, &msg)
+			if msg.Type == "participant_left" {
+				left++
+			}
+			continue
+		default:
+		}
+		break
+	}
+	if left != 1 {
+		t.Fatalf("peer got %d participant_left messages, want 1", left)
+	}
+}
+
+// Every log line about a client carries the request ID its connection came
+// in on, so it can be matched with the proxy's logs.
+func TestClientLogLinesCarryRequestID(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(io.Discard)
+
+	h := newTestHub(t)
+	rid := newTestRoomID(t)
+	a, b := newTestClient(h), newTestClient(h)
+	sendJSON(h, a, `{"v":1,"type":"offer","payload":{"sdp":"v=0"}}`) // not in a room yet
+	joinTestRoom(t, h, a, rid)
+	joinTestRoom(t, h, b, rid)
+	cids := map[*Client]string{a: a.cid, b: b.cid}
+	sendJSON(h, a, `{"v":1,"type":"offer","rid":%q,"payload":{"sdp":"v=0"}}`, rid)
+	sendJSON(h, a, `{"v":1,"type":"leave","rid":%q}`, rid)
+	h.disconnect(b, leaveReasonDisconnected)
+
+	for _, c := range []*Client{a, b} {
+		seen := 0
+		for _, line := range strings.Split(buf.String(), "\n") {
+			// Lines about c name it by sid, or by cid as a host or sender
+			if !strings.Contains(line, c.sid) && !strings.Contains(line, "Host "+cids[c]) && !strings.Contains(line, "from "+cids[c]) {
+				continue
+			}
+			seen++
+			if !strings.Contains(line, c.reqID) {
+				t.Errorf("log line about %s lacks its request ID %s: %s", c.sid, c.reqID, line)
+			}
+		}
+		if seen == 0 {
+			t.Errorf("no log lines about %s", c.sid)
+		}
+	}
+}
+
+// A browser's normal trickle of candidates is relayed in full; a flood is
+// cut off at the burst, with one RELAY_RATE_LIMITED error rather than one
+// per dropped message.
+func TestRelayRateLimit(t *testing.T) {
+	h := newTestHub(t)
+	h.relayRate, h.relayBurst = 50, 200
+
+	relayed := func(from, to *Client, rid string, n int) (delivered, limited int) {
+		for i := 0; i < n; i++ {
+			sendJSON(h, from, `{"v":1,"type":"ice","rid":%q,"payload":{"candidate":{"candidate":"candidate:%d 1 udp 2122260223 192.0.2.1 %d typ host","sdpMid":"0","sdpMLineIndex":0}}}`, rid, i, 50000+i)
+			for {
+				select {
+				case <-to.send:
+					delivered++
+					continue
+				default:
+				}
+				break
+			}
+		}
+		for {
+			select {
+			case out := <-from.send:
+				var msg Message
+				json.Unmarshal(out.data, &msg)
+				if msg.Type == "error" && strings.Contains(string(msg.Payload), string(ErrRelayRateLimited)) {
+					limited++
+				}
+				continue
+			default:
+			}
+			return delivered, limited
+		}
+	}
+	pair := func() (*Client, *Client, string) {
+		rid := newTestRoomID(t)
+		a, b := newTestClient(h), newTestClient(h)
+		joinTestRoom(t, h, a, rid)
+		joinTestRoom(t, h, b, rid)
+		drain(a)
+		drain(b)
+		return a, b, rid
+	}
+
+	a, b, rid := pair()
+	if delivered, limited := relayed(a, b, rid, 30); delivered != 30 || limited != 0 {
+		t.Errorf("trickle of 30 candidates: %d delivered, %d rate-limit errors; want 30, 0", delivered, limited)
+	}
+
+	a, b, rid = pair()
+	start := time.Now()
+	delivered, limited := relayed(a, b, rid, 2000)
+	elapsed := time.Since(start)
+	// The bucket refills while the flood is sent, slowly under -race
+	if maxDelivered := 200 + int(elapsed.Seconds()*50) + 1; delivered < 200 || delivered > maxDelivered {
+		t.Errorf("flood of 2000 candidates: %d delivered, want 200-%d", delivered, maxDelivered)
+	}
+	if maxLimited := 1 + int(elapsed/relayLimitedErrorInterval); limited < 1 || limited > maxLimited {
+		t.Errorf("flood of 2000 candidates: %d rate-limit errors, want 1-%d", limited, maxLimited)
+	}
+}
+
+// A room can be deleted while a member's relay is between looking it up
+// and locking it. Relays that lose the race, and any after it, get
+// ROOM_CLOSED. Run with -race.
+func TestRelayDuringRoomDeletion(t *testing.T) {
+	h := newTestHub(t)
+	h.relayRate, h.relayBurst = 1e9, 1e9
+
+	for i := 0; i < 50; i++ {
+		rid := newTestRoomID(t)
+		host, peer := newTestClient(h), newTestClient(h)
+		joinTestRoom(t, h, host, rid)
+		joinTestRoom(t, h, peer, rid)
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			sendJSON(h, host, `{"v":1,"type":"end_room","rid":%q}`, rid)
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				sendJSON(h, peer, `{"v":1,"type":"ice","rid":%q,"payload":{"candidate":null}}`, rid)
+			}
+		}()
+		wg.Wait()
+
+		if _, ok := h.rooms.get(rid); ok {
+			t.Fatalf("room %s not deleted", rid)
+		}
+		drain(peer)
+		sendJSON(h, peer, `{"v":1,"type":"ice","rid":%q,"payload":{"candidate":null}}`, rid)
+		assertErrorCode(t, peer, ErrRoomClosed)
+	}
+}
+
+// A client can't get its own "from" past the splice by escaping the key:
+// any \u in the payload sends it down the map path, which overrides it.
+func TestRelayFromCannotBeSpoofedWithEscapes(t *testing.T) {
+	for _, payload := range []string{
+		`{"fr\u006fm":"C-spoofed"}`,
+		`{"\u0066rom":"C-spoofed","candidate":{"candidate":"candidate:1 1 udp 2122260223 192.0.2.1 50000 typ host","sdpMid":"0","sdpMLineIndex":0}}`,
+		`{"client\u0054s":1}`,
+	} {
+		if _, ok := spliceFrom(json.RawMessage(payload), "C-real"); ok {
+			t.Errorf("spliceFrom accepted %s", payload)
+		}
+	}
+	if out, ok := spliceFrom(json.RawMessage(`{"candidate":null}`), "C-real"); !ok || string(out) != `{"from":"C-real","candidate":null}` {
+		t.Errorf("plain payload: got %s, %v", out, ok)
+	}
+
+	h := newTestHub(t)
+	rid := newTestRoomID(t)
+	a, b := newTestClient(h), newTestClient(h)
+	joinTestRoom(t, h, a, rid)
+	joinTestRoom(t, h, b, rid)
+	drain(b)
+	for _, msgType := range []string{"ice", "data"} {
+		sendJSON(h, a, `{"v":1,"type":%q,"rid":%q,"payload":{"fr\u006fm":"C-spoofed","candidate":null}}`, msgType, rid)
+		var payload struct {
+			From string `json:"from"`
+		}
+		if err := json.Unmarshal(nextOfType(t, b, msgType).Payload, &payload); err != nil {
+			t.Fatal(err)
+		}
+		if payload.From != a.cid {
+			t.Errorf("%s relayed with from %q, want %q", msgType, payload.From, a.cid)
+		}
+	}
+}
+
+func BenchmarkRelayPayload(b *testing.B) {
+	payload := json.RawMessage(`{"candidate":{"candidate":"candidate:1 1 udp 2122260223 192.0.2.1 50000 typ host generation 0 ufrag abcd","sdpMid":"0","sdpMLineIndex":0,"usernameFragment":"abcd"}}`)
+	b.Run("splice", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, ok := spliceFrom(payload, "C-0123456789abcdef"); !ok {
+				b.Fatal("not spliced")
+			}
+		}
+	})
+	b.Run("map", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var raw map[string]interface{}
+			json.Unmarshal(payload, &raw)
+			raw["from"] = "C-0123456789abcdef"
+			json.Marshal(raw)
+		}
+	})
+}
+
+// Suffixed duplicates stay within the display name limit, counted on the
+// text before HTML escaping, as a fresh name is.
+func TestUniqueDisplayNameFitsLimit(t *testing.T) {
+	h := newTestHub(t)
+	h.nicknamePolicy = nicknamePolicySuffix
+	rid := newTestRoomID(t)
+
+	// Observers, so the participant cap doesn't get in the way
+	for _, tc := range []struct{ name, want string }{
+		{"Alex", "Alex"},
+		{"Alex", "Alex (2)"},
+		{"alex", "alex (3)"},
+		{strings.Repeat("x", 40), strings.Repeat("x", 40)},
+		{strings.Repeat("x", 40), strings.Repeat("x", 36) + " (2)"},
+		{strings.Repeat("&", 40), strings.Repeat("&amp;", 40)},
+		{strings.Repeat("&", 40), strings.Repeat("&amp;", 36) + " (2)"},
+		{strings.Repeat("x", 35) + " yyyy", strings.Repeat("x", 35) + " yyyy"},
+		{strings.Repeat("x", 35) + " yyyy", strings.Repeat("x", 35) + " (2)"},
+	} {
+		c := newTestClient(h)
+		sendJSON(h, c, `{"v":1,"type":"join","rid":%q,"payload":{"role":"observer","displayName":%q}}`, rid, tc.name)
+		var payload struct {
+			Observers []Participant `json:"observers"`
+		}
+		if err := json.Unmarshal(nextOfType(t, c, "joined").Payload, &payload); err != nil {
+			t.Fatal(err)
+		}
+		got := ""
+		for _, p := range payload.Observers {
+			if p.CID == c.cid {
+				got = p.DisplayName
+			}
+		}
+		if got != tc.want {
+			t.Errorf("joined as %q: display name %q, want %q", tc.name, got, tc.want)
+		}
+		if n := len([]rune(html.UnescapeString(got))); n > maxDisplayNameLength {
+			t.Errorf("display name %q is %d characters, limit %d", got, n, maxDisplayNameLength)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Optional crash recovery for single-instance deployments. When STATE_FILE
+// is set, room membership is snapshotted periodically. On startup the rooms
+// are restored empty, with their members' seats held so a client that
+// rejoins with its resume token gets its old CID (and host role) back, as
+// long as the token hasn't expired. Rooms nobody rejoins are swept after
+// the usual retention. Until then the held seats count toward the room's
+// participant cap, so strangers can't fill them.
+const stateSnapshotInterval = 15 * time.Second
+
+type roomSnapshot struct {
+	RID          string           `json:"rid"`
+	HostCID      string           `json:"hostCid,omitempty"`
+	HostIdentity string           `json:"hostIdentity,omitempty"`
+	Capacity     int              `json:"capacity"`
+	Label        string           `json:"label,omitempty"`
+	CreatedAt    int64            `json:"createdAt"`
+	Members      []memberSnapshot `json:"members"`
+}
+
+type memberSnapshot struct {
+	CID  string `json:"cid"`
+	Role string `json:"role"`
+}
+
+// snapshotRooms captures every room with live or resumable members.
+func (h *Hub) snapshotRooms() []roomSnapshot {
+	snapshots := []roomSnapshot{}
+	for _, room := range h.rooms.snapshot() {
+		snap := func() roomSnapshot {
+			room.mu.Lock()
+			defer room.mu.Unlock()
+			snap := roomSnapshot{
+				RID:          room.RID,
+				HostCID:      room.HostCID,
+				HostIdentity: room.HostIdentity,
+				Capacity:     room.Capacity,
+				Label:        room.Label,
+				CreatedAt:    room.CreatedAt.UnixMilli(),
+			}
+			if snap.HostCID == "" {
+				snap.HostCID = room.resumeHost
+			}
+			for _, cid := range room.Participants {
+				snap.Members = append(snap.Members, memberSnapshot{CID: cid, Role: roleParticipant})
+			}
+			for _, cid := range room.Observers {
+				snap.Members = append(snap.Members, memberSnapshot{CID: cid, Role: roleObserver})
+			}
+			for cid, role := range room.resumable {
+				snap.Members = append(snap.Members, memberSnapshot{CID: cid, Role: role})
+			}
+			return snap
+		}()
+		if len(snap.Members) > 0 {
+			snapshots = append(snapshots, snap)
+		}
+	}
+	return snapshots
+}
+
+// saveState writes the snapshot to path atomically (temp file + rename).
+func (h *Hub) saveState(path string) error {
+	data, err := json.Marshal(h.snapshotRooms())
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".serenada-state-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// loadState restores rooms from path. A missing file is not an error.
+func (h *Hub) loadState(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var snapshots []roomSnapshot
+	if err := json.Unmarshal(data, &snapshots); err != nil {
+		return err
+	}
+
+	for _, snap := range snapshots {
+		// Skip rooms whose IDs no longer validate (e.g. rotated ROOM_ID_SECRET)
+		info, err := parseRoomID(snap.RID)
+		if err != nil {
+			continue
+		}
+		room, _, _ := h.rooms.getOrCreate(snap.RID)
+		func() {
+			room.mu.Lock()
+			defer room.mu.Unlock()
+			room.HostCID = ""
+			room.resumeHost = snap.HostCID
+			room.HostIdentity = snap.HostIdentity
+			room.Capacity = snap.Capacity
+			room.hostBound = info.hostBound
+			room.Label = snap.Label
+			if snap.CreatedAt > 0 {
+				room.CreatedAt = time.UnixMilli(snap.CreatedAt)
+			}
+			room.resumable = make(map[string]string, len(snap.Members))
+			for _, m := range snap.Members {
+				room.resumable[m.CID] = m.Role
+			}
+			// Held seats count toward the cap until the last resume token
+			// issued before the restart has expired
+			room.resumeUntil = time.Now().Add(h.resumeTokenTTL())
+		}()
+	}
+	log.Printf("[STATE] Restored %d rooms from %s", len(snapshots), path)
+	return nil
+}
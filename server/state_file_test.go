@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// After a restart, a full room's seats stay held for its members: strangers
+// and bare cids are turned away until the seats could no longer be resumed.
+func TestRestoredSeatsCountTowardCapacity(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	rid, err := generateRoomID(2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := newTestHub(t)
+	a, b := newTestClient(before), newTestClient(before)
+	tokenA := joinTestRoom(t, before, a, rid)["resumeToken"].(string)
+	joinTestRoom(t, before, b, rid)
+	if err := before.saveState(path); err != nil {
+		t.Fatal(err)
+	}
+
+	h := newTestHub(t)
+	if err := h.loadState(path); err != nil {
+		t.Fatal(err)
+	}
+
+	stranger := newTestClient(h)
+	sendJSON(h, stranger, `{"v":1,"type":"join","rid":%q}`, rid)
+	assertErrorCode(t, stranger, ErrRoomFull)
+
+	// Guessing a member's cid doesn't claim its seat
+	sendJSON(h, stranger, `{"v":1,"type":"join","rid":%q,"payload":{"reconnectCid":%q}}`, rid, b.cid)
+	assertErrorCode(t, stranger, ErrRoomFull)
+
+	// A returning member gets its seat back; the other one stays held
+	a2 := newTestClient(h)
+	sendJSON(h, a2, `{"v":1,"type":"join","rid":%q,"payload":{"resumeToken":%q}}`, rid, tokenA)
+	if joined := nextOfType(t, a2, "joined"); joined.CID != a.cid {
+		t.Fatalf("returning member got cid %s, want %s", joined.CID, a.cid)
+	}
+	sendJSON(h, stranger, `{"v":1,"type":"join","rid":%q}`, rid)
+	assertErrorCode(t, stranger, ErrRoomFull)
+
+	// Once no resume token can claim it, the held seat is released
+	room, _ := h.rooms.get(rid)
+	room.mu.Lock()
+	room.resumeUntil = time.Now().Add(-time.Second)
+	room.mu.Unlock()
+	joinTestRoom(t, h, stranger, rid)
+}
+
+// assertErrorCode fails unless c's next error has the given code.
+func assertErrorCode(t *testing.T, c *Client, code ErrorCode) {
+	t.Helper()
+	msg := nextOfType(t, c, "error")
+	var payload struct {
+		Code ErrorCode `json:"code"`
+	}
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Code != code {
+		t.Fatalf("got error %s, want %s", payload.Code, code)
+	}
+}
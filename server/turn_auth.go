@@ -11,14 +11,16 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
 type TurnConfig struct {
-	Username string   `json:"username"`
-	Password string   `json:"password"`
-	URIs     []string `json:"uris"`
-	TTL      int      `json:"ttl"`
+	Username  string   `json:"username"`
+	Password  string   `json:"password"`
+	URIs      []string `json:"uris"`
+	TTL       int      `json:"ttl"`       // seconds the credentials stay valid
+	ExpiresAt int64    `json:"expiresAt"` // unix seconds; refresh at ~80% of TTL
 }
 
 const (
@@ -34,10 +36,54 @@ type turnTokenClaims struct {
 	Exp  int64  `json:"exp"`
 }
 
+// How long a rotated-out TURN secret still validates turn tokens, unless
+// the rotation request says otherwise. Tokens live 5 minutes.
+const turnSecretOverlap = 10 * time.Minute
+
+// turnSecretRotation is a TURN_SECRET set at runtime through
+// /api/admin/turn-secret, plus the secret it replaced.
+type turnSecretRotation struct {
+	current       string
+	previous      string
+	previousUntil time.Time
+}
+
+var rotatedTurnSecret atomic.Pointer[turnSecretRotation]
+
+// turnSecret returns the shared secret for new TURN credentials: the last
+// rotated one, or TURN_SECRET.
+func turnSecret() string {
+	if rot := rotatedTurnSecret.Load(); rot != nil {
+		return rot.current
+	}
+	return os.Getenv("TURN_SECRET")
+}
+
+// rotateTurnSecret makes secret the TURN secret. The old one keeps
+// validating turn tokens for overlap. Concurrent rotations are applied one
+// after the other, so each one's previous is the secret it replaced.
+func rotateTurnSecret(secret string, overlap time.Duration) {
+	for {
+		old := rotatedTurnSecret.Load()
+		previous := os.Getenv("TURN_SECRET")
+		if old != nil {
+			previous = old.current
+		}
+		next := &turnSecretRotation{
+			current:       secret,
+			previous:      previous,
+			previousUntil: time.Now().Add(overlap),
+		}
+		if rotatedTurnSecret.CompareAndSwap(old, next) {
+			return
+		}
+	}
+}
+
 func getTurnTokenSecret() (string, error) {
 	secret := os.Getenv("TURN_TOKEN_SECRET")
 	if secret == "" {
-		secret = os.Getenv("TURN_SECRET")
+		secret = turnSecret()
 	}
 	if secret == "" {
 		return "", errors.New("TURN token secret not configured")
@@ -45,6 +91,23 @@ func getTurnTokenSecret() (string, error) {
 	return secret, nil
 }
 
+// turnTokenSecrets returns every secret a turn token may be signed with:
+// the signing secret and, when tokens are signed with a TURN secret that
+// was just rotated, the previous one until its overlap ends.
+func turnTokenSecrets() []string {
+	secret, err := getTurnTokenSecret()
+	if err != nil {
+		return nil
+	}
+	secrets := []string{secret}
+	if os.Getenv("TURN_TOKEN_SECRET") == "" {
+		if rot := rotatedTurnSecret.Load(); rot != nil && rot.previous != "" && time.Now().Before(rot.previousUntil) {
+			secrets = append(secrets, rot.previous)
+		}
+	}
+	return secrets
+}
+
 func issueTurnToken(ttl time.Duration, kind string) (string, time.Time, error) {
 	secret, err := getTurnTokenSecret()
 	if err != nil {
@@ -87,15 +150,16 @@ func parseTurnToken(token string) (turnTokenClaims, bool) {
 		return turnTokenClaims{}, false
 	}
 
-	secret, err := getTurnTokenSecret()
-	if err != nil {
-		return turnTokenClaims{}, false
+	valid := false
+	for _, secret := range turnTokenSecrets() {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(parts[0]))
+		if hmac.Equal(mac.Sum(nil), sigBytes) {
+			valid = true
+			break
+		}
 	}
-
-	mac := hmac.New(sha256.New, []byte(secret))
-	mac.Write([]byte(parts[0]))
-	expectedSig := mac.Sum(nil)
-	if !hmac.Equal(expectedSig, sigBytes) {
+	if !valid {
 		return turnTokenClaims{}, false
 	}
 
@@ -155,7 +219,7 @@ func handleTurnCredentials() http.HandlerFunc {
 		}
 
 		// 1. Get Secret and Host from Env
-		secret := os.Getenv("TURN_SECRET")
+		secret := turnSecret()
 		turn_host := os.Getenv("TURN_HOST")
 		stun_host := os.Getenv("STUN_HOST")
 		if secret == "" || stun_host == "" {
@@ -173,6 +237,15 @@ func handleTurnCredentials() http.HandlerFunc {
 		}
 		userPart = strings.ReplaceAll(userPart, ":", "-")
 		userPart = strings.ReplaceAll(userPart, "%", "-")
+		// ?rid= scopes the credentials to a room: the room ID replaces the
+		// client address in the username, for coturn to match on
+		if rid := r.URL.Query().Get("rid"); rid != "" {
+			if err := validateRoomID(rid); err != nil {
+				http.Error(w, "Invalid room ID", http.StatusBadRequest)
+				return
+			}
+			userPart = rid
+		}
 		username := fmt.Sprintf("%d:%s", timestamp, userPart)
 
 		// Password = HMAC-SHA1(secret, username)
@@ -187,7 +260,8 @@ func handleTurnCredentials() http.HandlerFunc {
 				"stun:" + stun_host,
 				"turn:" + stun_host,
 			},
-			TTL: ttl,
+			TTL:       ttl,
+			ExpiresAt: timestamp,
 		}
 
 		if turn_host != "" {
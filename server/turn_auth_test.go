@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Concurrent rotations each replace the secret current at the time, so
+// none is lost: the last one's previous is another rotated secret, never
+// the original TURN_SECRET that the first rotation already replaced.
+// Most likely to catch a lost update with -race -cpu 4.
+func TestConcurrentTurnSecretRotation(t *testing.T) {
+	defer rotatedTurnSecret.Store(nil)
+	original := os.Getenv("TURN_SECRET")
+
+	for round := 0; round < 100; round++ {
+		rotatedTurnSecret.Store(nil)
+		secrets := make(map[string]bool)
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			secret := fmt.Sprintf("secret-%d-%d", round, i)
+			secrets[secret] = true
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				rotateTurnSecret(secret, time.Minute)
+			}()
+		}
+		wg.Wait()
+
+		rot := rotatedTurnSecret.Load()
+		if !secrets[rot.current] {
+			t.Fatalf("current secret %q was never rotated in", rot.current)
+		}
+		if rot.previous == original || !secrets[rot.previous] || rot.previous == rot.current {
+			t.Fatalf("after 4 rotations from %q, previous is %q (current %q)", original, rot.previous, rot.current)
+		}
+	}
+}
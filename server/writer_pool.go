@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocket writes are done by a pool of goroutines instead of one
+// writePump per connection. Queuing a message (or a due ping) schedules the
+// client on the pool; a worker then drains its send channel. A client is
+// scheduled at most once at a time, so its conn is never written to by
+// two workers concurrently, and the queue never holds more than one entry
+// per client. Poll clients drain their channel in the request handler and
+// never use the pool.
+//
+// A write to a stalled peer blocks its worker for up to writeWait, and a
+// gorilla conn can't resume a timed-out write. So instead of letting a few
+// stalled peers tie up the whole pool, a worker that has spent longer than
+// slowFlushThreshold on one client is detached and replaced. It exits once
+// that flush ends, so the pool only grows by the number of peers stalled
+// at the same time.
+const slowFlushThreshold = 250 * time.Millisecond
+
+type writerPool struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	queue    []*Client     // clients due a flush
+	attached []*poolWorker // workers counted toward the pool size
+}
+
+type poolWorker struct {
+	busySince atomic.Int64 // start of the current flush (UnixNano), 0 when idle
+	detached  atomic.Bool  // replaced while stuck; exits after this flush
+}
+
+func newWriterPool(workers int) *writerPool {
+	p := &writerPool{}
+	p.cond = sync.NewCond(&p.mu)
+	p.mu.Lock()
+	for i := 0; i < workers; i++ {
+		p.startWorker()
+	}
+	p.mu.Unlock()
+	go p.watch()
+	return p
+}
+
+// startWorker adds an attached worker. Caller must hold p.mu.
+func (p *writerPool) startWorker() {
+	w := &poolWorker{}
+	p.attached = append(p.attached, w)
+	go p.work(w)
+}
+
+func (p *writerPool) work(w *poolWorker) {
+	for {
+		c := p.next()
+		w.busySince.Store(time.Now().UnixNano())
+		c.flush()
+		w.busySince.Store(0)
+		if w.detached.Load() {
+			return
+		}
+	}
+}
+
+// next waits for a scheduled client and takes it off the queue.
+func (p *writerPool) next() *Client {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(p.queue) == 0 {
+		p.cond.Wait()
+	}
+	c := p.queue[0]
+	p.queue[0] = nil
+	p.queue = p.queue[1:]
+	return c
+}
+
+// watch replaces workers stuck on one client for too long.
+func (p *writerPool) watch() {
+	ticker := time.NewTicker(slowFlushThreshold / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		cutoff := time.Now().Add(-slowFlushThreshold).UnixNano()
+		p.mu.Lock()
+		for i := 0; i < len(p.attached); i++ {
+			w := p.attached[i]
+			if busy := w.busySince.Load(); busy != 0 && busy < cutoff {
+				w.detached.Store(true)
+				p.attached = slices.Delete(p.attached, i, i+1)
+				i--
+				p.startWorker()
+			}
+		}
+		p.mu.Unlock()
+	}
+}
+
+// schedule queues c for a worker unless it's already queued. It never
+// blocks the caller, which may be holding a room lock.
+func (p *writerPool) schedule(c *Client) {
+	if !c.writeScheduled.CompareAndSwap(false, true) {
+		return
+	}
+	p.mu.Lock()
+	p.queue = append(p.queue, c)
+	p.mu.Unlock()
+	p.cond.Signal()
+}
+
+// schedulePings marks every WebSocket client as due a ping.
+func (h *Hub) schedulePings() {
+	for _, c := range h.clients.snapshot() {
+		if c.conn != nil {
+			c.pingDue.Store(true)
+			h.writers.schedule(c)
+		}
+	}
+}
+
+// flush writes everything queued for c, plus a ping if one is due. Once a
+// write fails the conn is closed (ending readPump) and further messages are
+// discarded.
+func (c *Client) flush() {
+	for {
+		c.drainWrites()
+		c.writeScheduled.Store(false)
+		// A message queued after the drain but before the flag was cleared
+		// found the client still scheduled; pick it up here.
+		if len(c.send) == 0 && !c.pingDue.Load() {
+			return
+		}
+		if !c.writeScheduled.CompareAndSwap(false, true) {
+			return
+		}
+	}
+}
+
+func (c *Client) drainWrites() {
+	if c.pingDue.Swap(false) && !c.writeFailed.Load() {
+		c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+		if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+			c.failWrites(err)
+		}
+	}
+	for {
+		select {
+		case message := <-c.send:
+			if c.writeFailed.Load() || c.stale(message) {
+				continue
+			}
+			if err := c.writeFrame(message.data); err != nil {
+				c.failWrites(err)
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (c *Client) writeFrame(message []byte) error {
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+
+	// Queued messages are already MessagePack for binary clients
+	frameType := websocket.TextMessage
+	if c.binary {
+		frameType = websocket.BinaryMessage
+	}
+
+	w, err := c.conn.NextWriter(frameType)
+	if err != nil {
+		return err
+	}
+	w.Write(message)
+
+	// Coalescing disabled to prevent JSON parsing errors on client
+	// if multiple messages are sent in one frame.
+
+	return w.Close()
+}
+
+func (c *Client) failWrites(err error) {
+	c.writeFailed.Store(true)
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		c.hub.writeTimeouts.Add(1)
+		log.Printf("[WRITE_TIMEOUT] Client %s (req %s, ip %s) not accepting writes within %v, closing", c.sid, c.reqID, c.ip, writeWait)
+		c.hub.notifyDegraded(c)
+	}
+	c.conn.Close()
+}
+
+// hasMember reports whether c is a participant or observer in r.
+func (r *Room) hasMember(c *Client) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, participant := r.Participants[c]
+	_, observer := r.Observers[c]
+	return participant || observer
+}
+
+// notifyDegraded tells everyone sharing a room with c that its connection
+// stopped keeping up, ahead of the participant_left its close will cause.
+// Only c's own rooms are looked at; one c is no longer a member of (e.g.
+// ended) is skipped.
+func (h *Hub) notifyDegraded(c *Client) {
+	for rid, cid := range c.memberships() {
+		room, ok := h.rooms.get(rid)
+		if !ok || !room.hasMember(c) {
+			continue
+		}
+		log.Printf("[WRITE_TIMEOUT] Client %s (req %s, CID: %s) degraded in room %s", c.sid, c.reqID, cid, room.RID)
+		payload, _ := json.Marshal(map[string]string{
+			"cid":    cid,
+			"reason": "write_timeout",
+		})
+		h.broadcastToRoom(room, Message{
+			V:       1,
+			Type:    "peer_connection_degraded",
+			RID:     room.RID,
+			Payload: payload,
+		}, c)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// pipeConn is an in-memory net.Conn for driving serveWs without sockets.
+// Reads block until it's closed, like an idle peer. Writes succeed unless
+// stalled, in which case they block until the write deadline, like a peer
+// whose receive window is full.
+type pipeConn struct {
+	addr    net.Addr
+	closed  chan struct{}
+	once    sync.Once
+	stalled atomic.Bool
+	written atomic.Int64
+
+	mu            sync.Mutex
+	writeDeadline time.Time
+}
+
+func newPipeConn(port int) *pipeConn {
+	return &pipeConn{
+		addr:   &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: port},
+		closed: make(chan struct{}),
+	}
+}
+
+func (p *pipeConn) Read([]byte) (int, error) {
+	<-p.closed
+	return 0, net.ErrClosed
+}
+
+func (p *pipeConn) Write(b []byte) (int, error) {
+	if p.stalled.Load() {
+		p.mu.Lock()
+		deadline := p.writeDeadline
+		p.mu.Unlock()
+		select {
+		case <-p.closed:
+			return 0, net.ErrClosed
+		case <-time.After(time.Until(deadline)):
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+	p.written.Add(int64(len(b)))
+	return len(b), nil
+}
+
+func (p *pipeConn) Close() error {
+	p.once.Do(func() { close(p.closed) })
+	return nil
+}
+
+func (p *pipeConn) LocalAddr() net.Addr             { return p.addr }
+func (p *pipeConn) RemoteAddr() net.Addr            { return p.addr }
+func (p *pipeConn) SetDeadline(time.Time) error     { return nil }
+func (p *pipeConn) SetReadDeadline(time.Time) error { return nil }
+
+func (p *pipeConn) SetWriteDeadline(t time.Time) error {
+	p.mu.Lock()
+	p.writeDeadline = t
+	p.mu.Unlock()
+	return nil
+}
+
+// hijackRecorder hands serveWs a pipeConn when it upgrades.
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+	conn *pipeConn
+}
+
+func (r hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return r.conn, bufio.NewReadWriter(bufio.NewReader(r.conn), bufio.NewWriter(r.conn)), nil
+}
+
+// upgradePipe runs a WebSocket upgrade over conn through serveWs.
+func upgradePipe(h *Hub, conn *pipeConn) {
+	r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+	r.RemoteAddr = conn.addr.String()
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	r.Header.Set("Sec-WebSocket-Version", "13")
+	r.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	serveWs(h, hijackRecorder{httptest.NewRecorder(), conn}, r)
+}
+
+func pipeClient(tb testing.TB, h *Hub, conn *pipeConn) *Client {
+	tb.Helper()
+	upgradePipe(h, conn)
+	for _, c := range h.clients.snapshot() {
+		if c.conn != nil && c.conn.UnderlyingConn() == conn {
+			return c
+		}
+	}
+	tb.Fatal("WebSocket client never registered")
+	return nil
+}
+
+// Peers that stop reading must not hold up writes to everyone else, even
+// when there are more of them than writers.
+func TestWriterPoolStalledPeersDontBlockOthers(t *testing.T) {
+	h := newTestHub(t)
+	h.ipConns = NewIPConnCounter(0)
+	h.writers = newWriterPool(2)
+
+	var conns []*pipeConn
+	t.Cleanup(func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+	for i := 0; i < 4; i++ {
+		conn := newPipeConn(40000 + i)
+		conns = append(conns, conn)
+		c := pipeClient(t, h, conn)
+		conn.stalled.Store(true)
+		c.sendMessage(Message{V: 1, Type: "pong"})
+	}
+	healthy := newPipeConn(41000)
+	conns = append(conns, healthy)
+	c := pipeClient(t, h, healthy)
+	before := healthy.written.Load()
+
+	// Let the stalled writes occupy every writer first
+	time.Sleep(50 * time.Millisecond)
+	c.sendMessage(Message{V: 1, Type: "pong"})
+
+	deadline := time.Now().Add(writeWait / 2)
+	for healthy.written.Load() == before {
+		if time.Now().After(deadline) {
+			t.Fatalf("healthy client got nothing within %v while 4 peers stalled 2 writers", writeWait/2)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// A peer that stops reading fills its send buffer and is closed as a slow
+// consumer. Closing it waits for the writer stuck on it, which must not
+// hold up relays in its room, sent with the room lock held.
+func TestSlowConsumerDoesntStallRoom(t *testing.T) {
+	h := newTestHub(t)
+	h.ipConns = NewIPConnCounter(0)
+	h.sendBuffer = 4
+	h.relayRate, h.relayBurst = 1e9, 1e9
+	rid := newTestRoomID(t)
+
+	conn := newPipeConn(42000)
+	t.Cleanup(func() { conn.Close() })
+	stalled := pipeClient(t, h, conn)
+	sendJSON(h, stalled, `{"v":1,"type":"join","rid":%q}`, rid)
+	sender := newTestClient(h)
+	joinTestRoom(t, h, sender, rid)
+	time.Sleep(50 * time.Millisecond) // let the join replies go out
+
+	conn.stalled.Store(true)
+	relay := func() {
+		sendJSON(h, sender, `{"v":1,"type":"ice","rid":%q,"payload":{"candidate":null}}`, rid)
+	}
+	relay()
+	time.Sleep(50 * time.Millisecond) // until a writer is stuck on the peer
+
+	start := time.Now()
+	for i := 0; i < h.sendBuffer+maxConsecutiveDrops+2; i++ {
+		relay()
+	}
+	if elapsed := time.Since(start); elapsed > writeWait/2 {
+		t.Fatalf("relays took %v with a stalled peer in the room", elapsed)
+	}
+}
+
+// A write timeout is reported in every room the client is in, current
+// and parked, without touching any other room.
+func TestNotifyDegradedOnlyLocksOwnRooms(t *testing.T) {
+	h := newTestHub(t)
+	first, second, other := newTestRoomID(t), newTestRoomID(t), newTestRoomID(t)
+
+	slow := newTestClient(h)
+	sendJSON(h, slow, `{"v":1,"type":"hello","payload":{"capabilities":["multi-room"]}}`)
+	firstPeer, secondPeer := newTestClient(h), newTestClient(h)
+	joinTestRoom(t, h, firstPeer, first)
+	joinTestRoom(t, h, slow, first)
+	joinTestRoom(t, h, secondPeer, second)
+	joinTestRoom(t, h, slow, second)
+	joinTestRoom(t, h, newTestClient(h), other)
+	drain(firstPeer)
+	drain(secondPeer)
+
+	busy, _ := h.rooms.get(other)
+	busy.mu.Lock()
+	notified := make(chan struct{})
+	go func() {
+		h.notifyDegraded(slow)
+		close(notified)
+	}()
+	select {
+	case <-notified:
+	case <-time.After(5 * time.Second):
+		t.Fatal("notifyDegraded waited on a room the client isn't in")
+	}
+	busy.mu.Unlock()
+
+	for _, peer := range []*Client{firstPeer, secondPeer} {
+		nextOfType(t, peer, "peer_connection_degraded")
+	}
+}
+
+// Goroutines and heap held per idle WebSocket connection. Run with
+// -bench IdleConnections -benchtime 1x.
+func BenchmarkIdleConnections(b *testing.B) {
+	const conns = 10000
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		h := newTestHub(b)
+		h.ipConns = NewIPConnCounter(0)
+		runtime.GC()
+		var before runtime.MemStats
+		runtime.ReadMemStats(&before)
+		goroutines := runtime.NumGoroutine()
+		b.StartTimer()
+
+		pipes := make([]*pipeConn, conns)
+		for j := range pipes {
+			pipes[j] = newPipeConn(1024 + j)
+			upgradePipe(h, pipes[j])
+		}
+
+		b.StopTimer()
+		runtime.GC()
+		var after runtime.MemStats
+		runtime.ReadMemStats(&after)
+		b.ReportMetric(float64(runtime.NumGoroutine()-goroutines)/conns, "goroutines/conn")
+		b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/conns, "heap-B/conn")
+		if n := len(h.clients.snapshot()); n != conns {
+			b.Fatalf("%d clients registered, want %d", n, conns)
+		}
+
+		for _, conn := range pipes {
+			conn.Close()
+		}
+		for len(h.clients.snapshot()) > 0 {
+			time.Sleep(time.Millisecond)
+		}
+		b.StartTimer()
+	}
+}